@@ -3,27 +3,27 @@ package conteo_traefik_cache
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
-
-	// "regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/igoooor/conteo-traefik-cache/provider"
 	"github.com/igoooor/conteo-traefik-cache/provider/api"
-
-	// "github.com/igoooor/conteo-traefik-cache/provider/local"
-	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
 )
 
-const healthcheckPeriod = 300 * time.Second
-
 // Config configures the middleware.
 type Config struct {
 	Path            string     `json:"path" yaml:"path" toml:"path"`
@@ -31,28 +31,75 @@ type Config struct {
 	Cleanup         int        `json:"cleanup" yaml:"cleanup" toml:"cleanup"`
 	Memory          bool       `json:"memory" yaml:"memory" toml:"memory"`
 	AddStatusHeader bool       `json:"addStatusHeader" yaml:"addStatusHeader" toml:"addStatusHeader"`
-	FlushHeader     string     `json:"flushHeader" yaml:"flushHeader" toml:"flushHeader"`
 	NextGenFormats  []string   `json:"nextGenFormats" yaml:"nextGenFormats" toml:"nextGenFormats"`
 	Headers         []string   `json:"headers" yaml:"headers" toml:"headers"`
 	Key             KeyContext `json:"key" yaml:"key" toml:"key"`
 	Debug           bool       `json:"debug" yaml:"debug" toml:"debug"`
-	// SurrogateKeys   map[string]SurrogateKeys `json:"surrogateKeys" yaml:"surrogateKeys" toml:"surrogateKeys"`
+	// StaleWhileRevalidate is the default number of seconds an expired entry
+	// may be served while it is refreshed in the background.
+	StaleWhileRevalidate int `json:"staleWhileRevalidate" yaml:"staleWhileRevalidate" toml:"staleWhileRevalidate"`
+	// StaleIfError is the default number of seconds an expired entry may be
+	// served when the backend fails.
+	StaleIfError int `json:"staleIfError" yaml:"staleIfError" toml:"staleIfError"`
+	// CoalesceTimeout is the number of seconds concurrent misses on the same
+	// key wait for the first one to fetch the response. 0 disables coalescing.
+	CoalesceTimeout int `json:"coalesceTimeout" yaml:"coalesceTimeout" toml:"coalesceTimeout"`
+	// Revalidate is the number of seconds entries with an ETag or
+	// Last-Modified header are kept after they expire, to be revalidated with
+	// a conditional request to the backend.
+	Revalidate int `json:"revalidate" yaml:"revalidate" toml:"revalidate"`
+	// Compression is the encoding compressible responses are stored in,
+	// "gzip" or "identity".
+	Compression string `json:"compression" yaml:"compression" toml:"compression"`
+	// SurrogateKeys tags the cached responses of the requests matching a rule
+	// with the rule name.
+	SurrogateKeys map[string]SurrogateKeys `json:"surrogateKeys" yaml:"surrogateKeys" toml:"surrogateKeys"`
+	// Purge configures the authentication of PURGE and BAN requests.
+	Purge PurgeConfig `json:"purge" yaml:"purge" toml:"purge"`
+	// Deprecated: FlushHeader was the header of the DELETE requests purging
+	// the cache, replaced by the PURGE and BAN requests configured by Purge.
+	// New fails when it is set.
+	FlushHeader string `json:"flushHeader" yaml:"flushHeader" toml:"flushHeader"`
+	// MaxBodySize is the size in bytes above which responses are streamed to
+	// the client without being cached. 0 disables the limit.
+	MaxBodySize int `json:"maxBodySize" yaml:"maxBodySize" toml:"maxBodySize"`
+	// Provider is the storage of the cached responses, "api", "local" or
+	// "memory", configured by API, Local and MemoryCache respectively.
+	Provider    string       `json:"provider" yaml:"provider" toml:"provider"`
+	API         APIConfig    `json:"api" yaml:"api" toml:"api"`
+	Local       LocalConfig  `json:"local" yaml:"local" toml:"local"`
+	MemoryCache MemoryConfig `json:"memoryCache" yaml:"memoryCache" toml:"memoryCache"`
+	// Fallback is the provider, "local" or "memory", used while the cache
+	// server of the api provider is unavailable. Empty disables the failover.
+	Fallback string `json:"fallback" yaml:"fallback" toml:"fallback"`
+	// HealthcheckPeriod is the number of seconds between two checks of the
+	// cache server availability.
+	HealthcheckPeriod int `json:"healthcheckPeriod" yaml:"healthcheckPeriod" toml:"healthcheckPeriod"`
+	// L1 puts a memory tier in front of the provider.
+	L1 L1Config `json:"l1" yaml:"l1" toml:"l1"`
 }
 
 type KeyContext struct {
-	DisableHost   bool `json:"disableHost" yaml:"disableHost" toml:"disableHost"`
-	DisableMethod bool `json:"disableMethod" yaml:"disableMethod" toml:"disableMethod"`
+	DisableHost      bool     `json:"disableHost" yaml:"disableHost" toml:"disableHost"`
+	DisableMethod    bool     `json:"disableMethod" yaml:"disableMethod" toml:"disableMethod"`
+	DisableQuery     bool     `json:"disableQuery" yaml:"disableQuery" toml:"disableQuery"`
+	SortQuery        bool     `json:"sortQuery" yaml:"sortQuery" toml:"sortQuery"`
+	QueryAllowlist   []string `json:"queryAllowlist" yaml:"queryAllowlist" toml:"queryAllowlist"`
+	QueryDenylist    []string `json:"queryDenylist" yaml:"queryDenylist" toml:"queryDenylist"`
+	IgnoreQueryPaths []string `json:"ignoreQueryPaths" yaml:"ignoreQueryPaths" toml:"ignoreQueryPaths"`
 }
 
-/*type SurrogateKeys struct {
-	URL     string            `json:"url" yaml:"url"`
-	Headers map[string]string `json:"headers" yaml:"headers"`
+// SurrogateKeys is a rule matching requests by URL and header regular
+// expressions.
+type SurrogateKeys struct {
+	URL     string            `json:"url" yaml:"url" toml:"url"`
+	Headers map[string]string `json:"headers" yaml:"headers" toml:"headers"`
 }
 
 type keysRegexpInner struct {
 	Headers map[string]*regexp.Regexp
 	Url     *regexp.Regexp
-}*/
+}
 
 // CreateConfig returns a config instance.
 func CreateConfig() *Config {
@@ -61,14 +108,49 @@ func CreateConfig() *Config {
 		Cleanup:         int((5 * time.Minute).Seconds()),
 		Memory:          false,
 		AddStatusHeader: true,
-		FlushHeader:     "X-Cache-Flush",
 		NextGenFormats:  []string{},
 		Headers:         []string{},
 		Key: KeyContext{
-			DisableHost:   false,
-			DisableMethod: false,
+			DisableHost:      false,
+			DisableMethod:    false,
+			DisableQuery:     false,
+			SortQuery:        true,
+			QueryAllowlist:   []string{},
+			QueryDenylist:    []string{"utm_*", "fbclid", "gclid"},
+			IgnoreQueryPaths: []string{},
+		},
+		Debug:                false,
+		StaleWhileRevalidate: 0,
+		StaleIfError:         0,
+		CoalesceTimeout:      0,
+		Revalidate:           int((5 * time.Minute).Seconds()),
+		Compression:          gzipEncoding,
+		SurrogateKeys:        map[string]SurrogateKeys{},
+		Purge: PurgeConfig{
+			MaxSkew: 300,
+		},
+		MaxBodySize: 10 << 20,
+		Provider:    apiProvider,
+		API: APIConfig{
+			BreakerThreshold:     5,
+			BreakerCooldown:      10,
+			DialTimeout:          1000,
+			ReadTimeout:          2000,
+			Timeout:              5000,
+			MaxIdleConns:         100,
+			MaxIdleConnsPerHost:  100,
+			IdleConnTimeout:      90000,
+			CompressionThreshold: 1024,
+		},
+		MemoryCache: MemoryConfig{
+			MaxSize: 64 << 20,
+		},
+		Fallback:          "",
+		HealthcheckPeriod: 30,
+		L1: L1Config{
+			MaxSize: 0,
+			TTL:     10,
 		},
-		Debug: false,
 	}
 }
 
@@ -79,29 +161,58 @@ const (
 	requestEtagHeader = "If-None-Match"
 	skipEtagHeader    = "X-Skip-Etag"
 	cacheHitStatus    = "hit; ttl=%d"
+	cacheStaleStatus  = "hit; stale"
 	cacheMissStatus   = "miss"
 	cacheErrorStatus  = "error"
 	acceptHeader      = "Accept"
 )
 
+// headersSeparator separates the URL of a cache key from the encoded values of
+// the configured headers. A request URI never contains a space, so it cannot
+// end like the headers of a key.
+const headersSeparator = " headers="
+
+// cacheUnavailableStatus is the status of the requests sent to the backend
+// without looking up the cache, because it is unavailable.
+const cacheUnavailableStatus = "miss; detail=cache-unavailable"
+
+// cacheCorruptStatus is the status of the requests whose entry failed its
+// checksum or could not be decoded, and was deleted.
+const cacheCorruptStatus = "error; detail=corrupt"
+
+// CacheSystem is a storage provider. Its methods return provider.ErrNotFound
+// for missing entries, errors matching provider.ErrUnavailable when the
+// storage cannot be reached, and provider.ErrCorrupt for unreadable entries.
 type CacheSystem interface {
-	Get(string, string) ([]byte, bool, error)
-	Delete(string)
-	Set(string, []byte, time.Duration, string) error
+	Get(context.Context, string, string) ([]byte, bool, error)
+	Delete(context.Context, string) error
+	Set(context.Context, string, []byte, time.Duration, time.Duration, string) error
 	Check(bool) bool
+	Tag(context.Context, string, []string, time.Duration) error
+	PurgeTag(context.Context, string) error
+	Keys(context.Context, string) ([]string, error)
 }
 
 type cache struct {
 	name           string
-	cache          api.FileCache
+	cache          CacheSystem
+	fallback       CacheSystem
 	cfg            *Config
 	next           http.Handler
+	availableMu    sync.RWMutex
 	cacheAvailable bool
-	// keysRegexp map[string]keysRegexpInner
+	refreshMu      sync.Mutex
+	refreshing     map[string]bool
+	flightsMu      sync.Mutex
+	flights        map[string]*flight
+	keysRegexp     map[string]keysRegexpInner
+	// purgeNonces records the accepted purge signatures, to reject replays.
+	purgeNonces provider.Nonces
 }
 
 // New returns a plugin instance.
-func New(_ context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
+// The background work of the instance stops once ctx is done.
+func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
 	if cfg.MaxExpiry <= 1 {
 		return nil, errors.New("maxExpiry must be greater or equal to 1")
 	}
@@ -110,29 +221,101 @@ func New(_ context.Context, next http.Handler, cfg *Config, name string) (http.H
 		return nil, errors.New("cleanup must be greater or equal to 1")
 	}
 
-	// temporarily disable local backup if api not available
-	fc, err := api.NewFileCache(cfg.Path)
+	if cfg.Compression != gzipEncoding && cfg.Compression != identityEncoding {
+		return nil, fmt.Errorf("compression must be %q or %q", gzipEncoding, identityEncoding)
+	}
+
+	if cfg.FlushHeader != "" {
+		return nil, errors.New("flushHeader is no longer supported, purge with PURGE or BAN requests authenticated by purge.token or purge.secret instead")
+	}
+
+	if cfg.MaxBodySize < 0 {
+		return nil, errors.New("maxBodySize must be greater or equal to 0")
+	}
+
+	if cfg.HealthcheckPeriod < 1 {
+		return nil, errors.New("healthcheckPeriod must be greater or equal to 1")
+	}
+
+	if cfg.Fallback == apiProvider || (cfg.Fallback != "" && cfg.Fallback == cfg.Provider) {
+		return nil, fmt.Errorf("fallback must be %q or %q, other than the provider", localProvider, memoryProvider)
+	}
+
+	if cfg.L1.MaxSize < 0 || cfg.L1.TTL < 1 {
+		return nil, errors.New("l1.maxSize must be greater or equal to 0 and l1.ttl to 1")
+	}
+
+	keysRegexp, err := compileSurrogateKeys(cfg.SurrogateKeys)
 	if err != nil {
 		return nil, err
 	}
 
-	//cacheAvailable := fc.Check(true)
+	// the providers are built last, as they start background work that
+	// the errors above would leave running
+	cs, err := newCacheSystem(cfg, cfg.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	l1, err := withL1(cfg, cs)
+	if err != nil {
+		stopCache(cs)
+		return nil, err
+	}
+	cs = l1
+
+	var fallback CacheSystem
+	if cfg.Fallback != "" {
+		if fallback, err = newCacheSystem(cfg, cfg.Fallback); err != nil {
+			stopCache(cs)
+			return nil, fmt.Errorf("invalid fallback: %w", err)
+		}
+	}
 
 	m := &cache{
 		name:           name,
-		cache:          *fc,
+		cache:          cs,
+		fallback:       fallback,
 		cfg:            cfg,
 		next:           next,
-		cacheAvailable: true,
-		//cacheAvailable: cacheAvailable,
-		//keysRegexp: keysRegexp,
+		cacheAvailable: cs.Check(false),
+		refreshing:     map[string]bool{},
+		flights:        map[string]*flight{},
+		keysRegexp:     keysRegexp,
 	}
 
-	// go m.cacheHealthcheck(healthcheckPeriod)
+	go m.cacheHealthcheck(ctx, time.Duration(cfg.HealthcheckPeriod)*time.Second)
 
 	return m, nil
 }
 
+// compileSurrogateKeys compiles the regular expressions of the surrogate key
+// rules.
+func compileSurrogateKeys(rules map[string]SurrogateKeys) (map[string]keysRegexpInner, error) {
+	keysRegexp := make(map[string]keysRegexpInner, len(rules))
+
+	for tag, rule := range rules {
+		inner := keysRegexpInner{Headers: make(map[string]*regexp.Regexp, len(rule.Headers))}
+
+		var err error
+		if rule.URL != "" {
+			if inner.Url, err = regexp.Compile(rule.URL); err != nil {
+				return nil, fmt.Errorf("invalid url in surrogate key %q: %w", tag, err)
+			}
+		}
+
+		for header, expr := range rule.Headers {
+			if inner.Headers[header], err = regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("invalid header %q in surrogate key %q: %w", header, tag, err)
+			}
+		}
+
+		keysRegexp[tag] = inner
+	}
+
+	return keysRegexp, nil
+}
+
 type cacheData struct {
 	Status  int
 	Headers map[string][]string
@@ -140,69 +323,144 @@ type cacheData struct {
 	Created uint64
 	Etag    string
 	Expiry  uint64
+	// StaleUntil is the time until which the entry may be served stale while
+	// it is being revalidated.
+	StaleUntil uint64
+	// StaleIfErrorUntil is the time until which the entry may be served
+	// stale when the backend fails.
+	StaleIfErrorUntil uint64
+
+	// tier is the provider tier the entry was read from, if any.
+	tier string
 }
 
-// ServeHTTP serves an HTTP request.
-func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	key := m.cacheKey(r)
+// tierCache is implemented by the providers made of several tiers, to report
+// which one an entry is read from.
+type tierCache interface {
+	GetTier(context.Context, string, string) ([]byte, bool, string, error)
+}
+
+// get reads an entry from cache, and the tier it is read from, if known.
+func get(ctx context.Context, cache CacheSystem, key, etag string) ([]byte, bool, string, error) {
+	if tc, ok := cache.(tierCache); ok {
+		return tc.GetTier(ctx, key, etag)
+	}
+
+	b, matchEtag, err := cache.Get(ctx, key, etag)
 
-	if r.Method == "DELETE" {
-		w.WriteHeader(204)
-		_, _ = w.Write([]byte{})
-		m.deleteCacheFile(key, r)
+	return b, matchEtag, "", err
+}
 
+// ServeHTTP serves an HTTP request.
+func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.isPurge(r) {
+		m.purge(w, r)
 		return
 	}
 
+	key := m.cacheKey(r)
+
 	cs := cacheMissStatus
 
+	// stale holds an expired entry that can still replace a backend error.
+	var stale *cacheData
+	// expired holds an expired entry to revalidate with the backend.
+	var expired *cacheData
+
 	if m.bypassingHeaders(r) {
-		rw := &responseWriter{ResponseWriter: w}
-		m.next.ServeHTTP(rw, r)
+		m.next.ServeHTTP(w, r)
 
 		return
 	}
 
 	cache, err := m.getCache()
 	if err != nil {
-		rw := &responseWriter{ResponseWriter: w}
-		m.next.ServeHTTP(rw, r)
+		m.bypass(w, r)
 
 		return
 	}
 
-	b, matchEtag, err := cache.Get(key, getRequestEtag(r))
+	// dataKey is the key of the entry, which differs from key for the
+	// variants of responses with a Vary header.
+	dataKey := key
+
+	requestEtag := getRequestEtag(r)
+
+	b, matchEtag, tier, err := get(r.Context(), cache, key, requestEtag)
+	if vary, ok := parseVaryMarker(b); ok && err == nil && !matchEtag {
+		dataKey = m.variantKey(key, vary, r)
+		b, matchEtag, tier, err = get(r.Context(), cache, dataKey, requestEtag)
+	}
 	if matchEtag {
 		if m.cfg.Debug {
 			log.Printf("[Cache] DEBUG hit + match etag")
 		}
+		w.Header().Set(etagHeader, requestEtag)
 		w.WriteHeader(304)
 		return
 	}
-	if err != nil {
+	switch {
+	case errors.Is(err, provider.ErrNotFound):
+	case errors.Is(err, provider.ErrCorrupt):
+		log.Printf("Error reading cache item %q: %v", dataKey, err)
+		cs = cacheCorruptStatus
+	case err != nil:
 		if m.handleCacheErrorAndExit(err, w, r) {
 			return
 		}
-	} else if b != nil {
-		var data cacheData
-
-		err := json.Unmarshal(b, &data)
+	case b != nil:
+		data, err := decodeEntry(b)
+		data.tier = tier
 		if err != nil || data.Status > 299 || m.invalidCacheBody(data) {
 			if m.cfg.Debug {
 				if err != nil {
-					log.Printf("[Cache] DEBUG error: unmarshalling cache item: %v", err)
+					log.Printf("[Cache] DEBUG error: decoding cache item: %v", err)
 				} else if data.Status > 299 {
 					log.Printf("[Cache] DEBUG error: cache item status: %d", data.Status)
 				} else {
 					log.Printf("[Cache] DEBUG error: invalid body")
 				}
 			}
-			cs = cacheErrorStatus
+			cs = cacheCorruptStatus
+			if err == nil && data.Status > 299 {
+				cs = cacheErrorStatus
+			}
 			// if cache error, delete the cache data
-			cache.Delete(key)
-		} else {
-			m.sendCacheFile(w, data, r, key)
+			if err := cache.Delete(r.Context(), dataKey); err != nil {
+				log.Printf("Error deleting cache item: %v", err)
+			}
+		} else if now := uint64(time.Now().Unix()); now < data.Expiry {
+			m.sendCacheFile(w, data, r, dataKey)
+			return
+		} else if now < data.StaleUntil {
+			m.refresh(r, key, dataKey, data)
+			m.sendCacheFile(w, data, r, dataKey)
 			return
+		} else {
+			if now < data.StaleIfErrorUntil {
+				stale = &data
+			}
+			if hasValidators(data) {
+				expired = &data
+			}
+		}
+	}
+
+	var f *flight
+	if m.cfg.CoalesceTimeout > 0 {
+		var leader bool
+		if f, leader = m.joinFlight(dataKey); leader {
+			defer m.leaveFlight(dataKey, f)
+		} else {
+			// the leader's response may be a variant for other request headers
+			if data := m.waitFlight(r.Context(), f); data != nil && m.storageKey(key, data.Headers, r) == f.key {
+				if m.cfg.Debug {
+					log.Printf("[Cache] DEBUG coalesced %s", f.key)
+				}
+				m.sendCacheFile(w, *data, r, f.key)
+				return
+			}
+			f = nil
 		}
 	}
 
@@ -214,41 +472,355 @@ func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(cacheHeader, cs)
 	}
 
-	rw := &responseWriter{ResponseWriter: w}
-	m.next.ServeHTTP(rw, r)
+	req := r
+	if expired != nil {
+		req = r.Clone(r.Context())
+		setValidators(req, *expired)
+	}
+
+	// cacheable responses are held back until complete to add their ETag,
+	// server errors to replace them with the stale entry, if any, and
+	// revalidations to send the cached entry instead
+	rw := newResponseWriter(w, m.cfg.MaxBodySize, func(status int, header http.Header) bool {
+		switch {
+		case status >= http.StatusInternalServerError:
+			return stale != nil
+		case status == http.StatusNotModified:
+			return expired != nil
+		}
+
+		_, ok := m.freshness(r, status, header)
+		return ok
+	})
+	m.next.ServeHTTP(rw, req)
+	rw.finish()
 
 	if m.cfg.Debug {
 		log.Printf("[Cache] DEBUG Backend response Body length: %d", len(rw.body))
 	}
 
-	expiry, ok := m.cacheable(r, w, rw)
-	if !ok {
+	if rw.overflow && !rw.held {
+		if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG response larger than %d bytes, not cached", m.cfg.MaxBodySize)
+		}
+		return
+	}
+
+	if rw.status == http.StatusPartialContent && rangeRequest(r) {
+		// the full body is fetched apart to be stored, if it fits
+		if m.fillable(r, rw.Header()) {
+			m.refresh(r, key, dataKey, cacheData{})
+		}
+		return
+	}
+
+	if rw.held && rw.status >= http.StatusInternalServerError {
+		if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG backend error %d, serving stale", rw.status)
+		}
+		m.sendCacheFile(w, *stale, r, dataKey)
+		return
+	}
+
+	if rw.held && rw.status == http.StatusNotModified {
+		if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG revalidated %s", dataKey)
+		}
+
+		data, err := m.revalidated(cache, r, key, *expired, rw.Header())
+		if err != nil {
+			log.Printf("Error refreshing cache item: %v", err)
+		}
+		if data == nil {
+			data = expired
+		}
+
+		m.sendCacheFile(w, *data, r, dataKey)
+
+		if f != nil {
+			f.data = data
+			f.key = dataKey
+		}
+		return
+	}
+
+	// responses which are not held back are not cacheable
+	if !rw.held {
 		return
 	}
 
+	// the response is stored in the configured encoding
+	header, body := m.normalizeEncoding(rw.Header(), rw.body)
+
+	etag := rw.Header().Get(etagHeader)
+	if etag == "" {
+		etag = representationEtag(entityTag(m.storageKey(key, header, r), header, body), header, rw.Header())
+	}
+	// the hits of an entry stored in another encoding vary with it
+	if contentEncoding(header) != contentEncoding(rw.Header()) {
+		addVary(rw.Header(), acceptEncodingHeader)
+	}
+	rw.commit(r, etag)
+
+	data, err := m.store(cache, r, key, header, rw.status, body)
+	if err != nil {
+		log.Println("Error setting cache item")
+		// the response is already sent
+		if m.cacheError(err) {
+			return
+		}
+	}
+
+	if f != nil && data != nil {
+		f.data = data
+		f.key = m.storageKey(key, data.Headers, r)
+	}
+}
+
+// store saves a captured backend response in the cache, if it is cacheable,
+// and returns the stored entry. Responses with a Vary header are stored as a
+// variant of key, and the Vary header list is stored at key.
+func (m *cache) store(cache CacheSystem, r *http.Request, key string, header http.Header, status int, body []byte) (*cacheData, error) {
+	expiry, ok := m.cacheable(r, header, status, body)
+	if !ok {
+		return nil, nil
+	}
+
+	dataKey := m.storageKey(key, header, r)
+
+	staleWhileRevalidate, staleIfError := m.staleWindows(header)
+
 	createdTs := uint64(time.Now().Unix())
 	data := cacheData{
-		Status:  rw.status,
-		Headers: w.Header(),
-		Body:    rw.body,
+		Status:  status,
+		Headers: header,
+		Body:    body,
 		Created: createdTs,
-		Etag:    calculateEtag(createdTs),
+		Etag:    entityTag(dataKey, header, body),
 		Expiry:  uint64(time.Now().Add(expiry).Unix()),
 	}
 
-	b, err = json.Marshal(data)
+	if staleWhileRevalidate > 0 {
+		data.StaleUntil = uint64(time.Now().Add(expiry + staleWhileRevalidate).Unix())
+	}
+
+	if staleIfError > 0 {
+		data.StaleIfErrorUntil = uint64(time.Now().Add(expiry + staleIfError).Unix())
+	}
+
+	ttl := expiry + staleWhileRevalidate
+	if staleIfError > staleWhileRevalidate {
+		ttl = expiry + staleIfError
+	}
+
+	if revalidate := time.Duration(m.cfg.Revalidate) * time.Second; hasValidators(data) && expiry+revalidate > ttl {
+		ttl = expiry + revalidate
+	}
+
+	// the entry is stored even if the client is gone
+	ctx := detachedContext{r.Context()}
+
+	if err := cache.Set(ctx, dataKey, encodeEntry(data), expiry, ttl, data.Etag); err != nil {
+		return nil, err
+	}
+	if m.cfg.Debug {
+		log.Printf("[Cache] DEBUG set %s", dataKey)
+	}
+
+	if vary := keyVary(header); len(vary) > 0 {
+		if err := cache.Set(ctx, key, varyMarker(vary), expiry, ttl, varyPrefix+data.Etag); err != nil {
+			return nil, err
+		}
+	}
+
+	tags := m.surrogateKeys(r, header)
+	if dataKey != key {
+		tags = append(tags, variantsTag(key))
+	}
+
+	if len(tags) > 0 {
+		if err := cache.Tag(ctx, dataKey, tags, ttl); err != nil {
+			log.Printf("Error tagging cache item: %v", err)
+		} else if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG tag %s: %v", dataKey, tags)
+		}
+	}
+
+	return &data, nil
+}
+
+// staleWindows returns how long a response may be served stale while it is
+// refreshed and when the backend fails, from its Cache-Control header or the
+// configured defaults.
+func (m *cache) staleWindows(header http.Header) (time.Duration, time.Duration) {
+	staleWhileRevalidate := time.Duration(m.cfg.StaleWhileRevalidate) * time.Second
+	staleIfError := time.Duration(m.cfg.StaleIfError) * time.Second
+
+	cc, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
 	if err != nil {
-		log.Printf("Error serializing cache item: %v", err)
+		return staleWhileRevalidate, staleIfError
 	}
 
-	if err = cache.Set(key, b, expiry, data.Etag); err != nil {
-		log.Println("Error setting cache item")
-		if m.handleCacheErrorAndExit(err, w, r) {
+	if cc.StaleWhileRevalidate >= 0 {
+		staleWhileRevalidate = time.Duration(cc.StaleWhileRevalidate) * time.Second
+	}
+
+	if cc.StaleIfError >= 0 {
+		staleIfError = time.Duration(cc.StaleIfError) * time.Second
+	}
+
+	return staleWhileRevalidate, staleIfError
+}
+
+// refresh fetches a fresh copy of the entry at dataKey from the backend in the
+// background, or revalidates data when it has validators. Only one refresh per
+// entry runs at a time.
+func (m *cache) refresh(r *http.Request, key, dataKey string, data cacheData) {
+	m.refreshMu.Lock()
+	if m.refreshing[dataKey] {
+		m.refreshMu.Unlock()
+		return
+	}
+	m.refreshing[dataKey] = true
+	m.refreshMu.Unlock()
+
+	req := r.Clone(detachedContext{r.Context()})
+	req.Header.Del(requestEtagHeader)
+	req.Header.Del("If-Modified-Since")
+	delRange(req)
+	setValidators(req, data)
+
+	go func() {
+		defer func() {
+			m.refreshMu.Lock()
+			delete(m.refreshing, dataKey)
+			m.refreshMu.Unlock()
+		}()
+
+		rw := &responseWriter{ResponseWriter: &discardWriter{header: http.Header{}}, limit: m.cfg.MaxBodySize}
+		m.next.ServeHTTP(rw, req)
+		rw.finish()
+
+		cache, err := m.getCache()
+		if err != nil || rw.overflow {
 			return
 		}
+
+		if rw.status == http.StatusNotModified && hasValidators(data) {
+			_, err = m.revalidated(cache, req, key, data, rw.Header())
+		} else if _, ok := m.cacheable(req, rw.Header(), rw.status, rw.body); ok {
+			header, body := m.normalizeEncoding(rw.Header(), rw.body)
+			_, err = m.store(cache, req, key, header, rw.status, body)
+		}
+		if err != nil {
+			log.Printf("Error refreshing cache item: %v", err)
+		}
+	}()
+}
+
+// hasValidators reports whether the entry can be revalidated with the
+// backend.
+func hasValidators(data cacheData) bool {
+	h := http.Header(data.Headers)
+	return h.Get(etagHeader) != "" || h.Get("Last-Modified") != ""
+}
+
+// setValidators makes req conditional on the ETag and Last-Modified headers of
+// the entry, if any.
+func setValidators(req *http.Request, data cacheData) {
+	if !hasValidators(data) {
+		return
 	}
-	if m.cfg.Debug {
-		log.Printf("[Cache] DEBUG set %s", key)
+
+	req.Header.Del(requestEtagHeader)
+	req.Header.Del("If-Modified-Since")
+
+	h := http.Header(data.Headers)
+	if etag := h.Get(etagHeader); etag != "" {
+		req.Header.Set(requestEtagHeader, etag)
+	}
+	if lastModified := h.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// revalidated refreshes an entry, keeping its body, after the backend
+// answered a conditional request with the given 304 response headers. The
+// ETag of the backend representation is made weak when the entry was stored
+// in another encoding, as normalizeEncoding does.
+func (m *cache) revalidated(cache CacheSystem, r *http.Request, key string, data cacheData, header http.Header) (*cacheData, error) {
+	stored := http.Header(data.Headers)
+	headers := stored.Clone()
+	for k, v := range header {
+		if k == "Content-Length" || k == cacheHeader {
+			continue
+		}
+		headers[k] = v
+	}
+
+	if etag := headers.Get(etagHeader); etag != "" && strings.HasPrefix(stored.Get(etagHeader), "W/") {
+		headers.Set(etagHeader, weakEtag(etag))
+	}
+
+	return m.store(cache, r, key, headers, data.Status, data.Body)
+}
+
+// storageKey returns the key a response to r is stored at, which is a variant
+// of key when the response has a Vary header.
+func (m *cache) storageKey(key string, header http.Header, r *http.Request) string {
+	if vary := keyVary(header); len(vary) > 0 {
+		return m.variantKey(key, vary, r)
+	}
+
+	return key
+}
+
+// flight is a backend request shared by concurrent misses on the same key.
+type flight struct {
+	done chan struct{}
+	// data is the stored entry, or nil if the response was not cacheable.
+	data *cacheData
+	// key is the key data was stored at.
+	key string
+}
+
+// joinFlight returns the flight for key, and whether the caller started it
+// and must fetch the response.
+func (m *cache) joinFlight(key string) (*flight, bool) {
+	m.flightsMu.Lock()
+	defer m.flightsMu.Unlock()
+
+	if f, ok := m.flights[key]; ok {
+		return f, false
+	}
+
+	f := &flight{done: make(chan struct{})}
+	m.flights[key] = f
+
+	return f, true
+}
+
+func (m *cache) leaveFlight(key string, f *flight) {
+	m.flightsMu.Lock()
+	delete(m.flights, key)
+	m.flightsMu.Unlock()
+
+	close(f.done)
+}
+
+// waitFlight waits for the leader of f and returns its entry, or nil on
+// timeout or if the response could not be cached.
+func (m *cache) waitFlight(ctx context.Context, f *flight) *cacheData {
+	timer := time.NewTimer(time.Duration(m.cfg.CoalesceTimeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.data
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return nil
 	}
 }
 
@@ -262,23 +834,36 @@ func (m *cache) invalidCacheBody(data cacheData) bool {
 	return false
 }
 
-func (m *cache) cacheable(r *http.Request, w http.ResponseWriter, rw *responseWriter) (time.Duration, bool) {
-	if rw.status > 299 {
+func (m *cache) cacheable(r *http.Request, header http.Header, status int, body []byte) (time.Duration, bool) {
+	bodyLength := len(body)
+	if bodyLength == 0 {
 		return 0, false
 	}
 
-	bodyLength := len(rw.body)
-	if bodyLength == 0 {
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		if cl, err := strconv.Atoi(contentLength); err == nil && cl != bodyLength {
+			return 0, false
+		}
+	}
+
+	return m.freshness(r, status, header)
+}
+
+// freshness returns how long a response with the given status and headers
+// may be cached, and whether it may be cached at all.
+func (m *cache) freshness(r *http.Request, status int, header http.Header) (time.Duration, bool) {
+	// partial content is never stored in place of the full body
+	if status > 299 || status == http.StatusPartialContent {
 		return 0, false
 	}
 
-	if contentLength := w.Header().Get("Content-Length"); contentLength != "" {
-		if cl, err := strconv.Atoi(contentLength); err == nil && cl != bodyLength {
+	for _, vary := range varyHeaders(header) {
+		if vary == "*" {
 			return 0, false
 		}
 	}
 
-	reasons, expireBy, err := cachecontrol.CachableResponseWriter(r, rw.status, w, cachecontrol.Options{})
+	reasons, expireBy, err := cacheobject.UsingRequestResponse(r, status, header, false)
 	if err != nil || len(reasons) > 0 {
 		return 0, false
 	}
@@ -290,15 +875,7 @@ func (m *cache) cacheable(r *http.Request, w http.ResponseWriter, rw *responseWr
 		expiry = maxExpiry
 	}
 
-	return expiry, true
-}
-
-func (m *cache) deleteCacheFile(key string, r *http.Request) {
-	if flushHeader := r.Header.Get(m.cfg.FlushHeader); flushHeader != "" {
-		if cache, err := m.getCache(); err == nil {
-			cache.Delete(key)
-		}
-	}
+	return expiry, expiry > 0
 }
 
 func (m *cache) sendCacheFile(w http.ResponseWriter, data cacheData, r *http.Request, cacheKey string) {
@@ -307,7 +884,15 @@ func (m *cache) sendCacheFile(w http.ResponseWriter, data cacheData, r *http.Req
 		log.Printf("[Cache] DEBUG Cache Body length: %d", len(data.Body))
 	}
 
-	if getRequestEtag(r) == data.Etag {
+	body, decoded := decodeForClient(r, data)
+
+	etag := data.Etag
+	if decoded {
+		etag = weakEtag(etag)
+	}
+
+	if notModified(r, etag) {
+		w.Header().Set(etagHeader, etag)
 		w.WriteHeader(304)
 		return
 	}
@@ -328,55 +913,180 @@ func (m *cache) sendCacheFile(w http.ResponseWriter, data cacheData, r *http.Req
 	if m.cfg.AddStatusHeader {
 		now := uint64(time.Now().Unix())
 		age := now - data.Created
-		ttl := data.Expiry - now
-		w.Header().Set(cacheHeader, fmt.Sprintf(cacheHitStatus, ttl))
+		status := cacheStaleStatus
+		if now < data.Expiry {
+			status = fmt.Sprintf(cacheHitStatus, data.Expiry-now)
+		}
+		if data.tier != "" {
+			status += "; detail=" + data.tier
+		}
+		w.Header().Set(cacheHeader, status)
 		w.Header().Set(ageHeader, strconv.FormatUint(age, 10))
 	}
 
-	w.Header().Set(etagHeader, data.Etag)
+	if decoded {
+		w.Header().Del(contentEncodingHeader)
+	}
+	if contentEncoding(http.Header(data.Headers)) == gzipEncoding {
+		addVary(w.Header(), acceptEncodingHeader)
+	}
+
+	data.Body = body
+	data.Etag = etag
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set(etagHeader, etag)
+
+	if data.Status == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if sendRange(w, r, data) {
+			return
+		}
+	}
+
 	w.WriteHeader(data.Status)
 
 	_, _ = w.Write(data.Body)
 }
 
+// getRequestEtag returns the entity tag passed to the cache provider to
+// check for a match, when the request has a single one.
 func getRequestEtag(r *http.Request) string {
 	if r.Header.Get(skipEtagHeader) != "" {
 		return "n/a"
 	}
-	return r.Header.Get(requestEtagHeader)
+
+	tags := parseEtags(r.Header.Get(requestEtagHeader))
+	if len(tags) != 1 || tags[0] == "*" {
+		return ""
+	}
+
+	return strings.TrimPrefix(tags[0], "W/")
 }
 
-func calculateEtag(created uint64) string {
-	bs := make([]byte, 8)
-	binary.LittleEndian.PutUint64(bs, created)
-	return base64.URLEncoding.EncodeToString(bs)
+// notModified reports whether the If-None-Match header of r matches etag,
+// using the weak comparison.
+func notModified(r *http.Request, etag string) bool {
+	if r.Header.Get(skipEtagHeader) != "" || etag == "" {
+		return false
+	}
+
+	for _, tag := range parseEtags(r.Header.Get(requestEtagHeader)) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
 }
 
+// parseEtags splits a list of entity tags.
+func parseEtags(value string) []string {
+	tags := []string{}
+
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// entityTag returns the ETag of a response stored at key: the one sent by the
+// backend, or one computed from the body.
+func entityTag(key string, header http.Header, body []byte) string {
+	if etag := header.Get(etagHeader); etag != "" {
+		return etag
+	}
+
+	return calculateEtag(key, body)
+}
+
+// calculateEtag returns a strong entity tag for a body stored at key.
+func calculateEtag(key string, body []byte) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(body)
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// bypassingHeaders reports whether r goes straight to the backend, which is
+// also the case of PURGE and BAN requests when purging is not configured.
 func (m *cache) bypassingHeaders(r *http.Request) bool {
-	return r.Header.Get("X-Conteo-Cache-Control") == "no-cache"
+	switch r.Method {
+	case http.MethodDelete, purgeMethod, banMethod:
+		return true
+	}
+
+	return r.Header.Get("X-Conteo-Cache-Control") == "no-cache" || streamingRequest(r)
 }
 
-/*func (m *cache) matchSurrogateKeys(r *http.Request) []string {
+// surrogateKeys returns the tags of a response, from the configured rules
+// and the Surrogate-Key and Cache-Tag response headers.
+func (m *cache) surrogateKeys(r *http.Request, header http.Header) []string {
+	tags := m.matchSurrogateKeys(r)
+	tags = append(tags, splitTags(header.Get("Surrogate-Key"))...)
+	tags = append(tags, splitTags(header.Get("Cache-Tag"))...)
+
+	return tags
+}
+
+func (m *cache) matchSurrogateKeys(r *http.Request) []string {
 	matchKeys := []string{}
 
+out:
+	for tag, rule := range m.keysRegexp {
+		if rule.Url != nil && !rule.Url.MatchString(r.URL.RequestURI()) {
+			continue
+		}
+
+		for header, expr := range rule.Headers {
+			if !expr.MatchString(r.Header.Get(header)) {
+				continue out
+			}
+		}
+
+		matchKeys = append(matchKeys, tag)
+	}
+
 	return matchKeys
-}*/
+}
 
-func (m *cache) cacheKey(r *http.Request) string {
+// splitTags splits a space or comma separated list of tags.
+func splitTags(value string) []string {
+	return strings.FieldsFunc(value, func(c rune) bool {
+		return c == ' ' || c == ','
+	})
+}
+
+// keyPrefix returns the method and host part of the cache key.
+func (m *cache) keyPrefix(r *http.Request) string {
 	key := ""
 	if !m.cfg.Key.DisableMethod {
-		if r.Method == "DELETE" {
-			key += "-GET" // DELETE requests are treated as GET for key generation
-		} else {
-			key += "-" + r.Method
-		}
+		key += "-" + r.Method
 	}
 
 	if !m.cfg.Key.DisableHost {
 		key += "-" + r.Host
 	}
 
-	key += "-" + strings.Split(r.URL.Path, "#")[0]
+	if key == "" {
+		return ""
+	}
+
+	return strings.TrimLeft(key, "-") + "-"
+}
+
+func (m *cache) cacheKey(r *http.Request) string {
+	key := m.keyPrefix(r) + escapePath(r.URL.Path)
+
+	if query := m.queryKey(r); query != "" {
+		key += "?" + query
+	}
 
 	headers := ""
 
@@ -387,8 +1097,7 @@ func (m *cache) cacheKey(r *http.Request) string {
 	}
 
 	if headers != "" {
-		headers = base64.StdEncoding.EncodeToString([]byte(headers))
-		key += "-" + headers
+		key += headersSeparator + base64.StdEncoding.EncodeToString([]byte(headers))
 	}
 
 	if r.Header.Get(acceptHeader) != "" {
@@ -415,20 +1124,128 @@ func (m *cache) cacheKey(r *http.Request) string {
 	return key
 }
 
+// escapePath returns the canonical escaped form of the decoded path p, in
+// which "?" is escaped, so that a path cannot pass for a query string in a
+// cache key.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// queryKey returns the normalized query string used in the cache key.
+func (m *cache) queryKey(r *http.Request) string {
+	if m.cfg.Key.DisableQuery || r.URL.RawQuery == "" {
+		return ""
+	}
+
+	for _, p := range m.cfg.Key.IgnoreQueryPaths {
+		if matchWildcard(p, r.URL.Path) {
+			return ""
+		}
+	}
+
+	type queryParam struct {
+		name, param string
+	}
+
+	params := []queryParam{}
+
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		name := strings.SplitN(param, "=", 2)[0]
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+
+		if m.keepQueryParam(name) {
+			params = append(params, queryParam{name: name, param: param})
+		}
+	}
+
+	// only the names are sorted: the values of a repeated parameter keep
+	// their order, which may be significant to the backend
+	if m.cfg.Key.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].name < params[j].name
+		})
+	}
+
+	query := make([]string, len(params))
+	for i, p := range params {
+		query[i] = p.param
+	}
+
+	return strings.Join(query, "&")
+}
+
+func (m *cache) keepQueryParam(name string) bool {
+	for _, pattern := range m.cfg.Key.QueryDenylist {
+		if matchWildcard(pattern, name) {
+			return false
+		}
+	}
+
+	if len(m.cfg.Key.QueryAllowlist) == 0 {
+		return true
+	}
+
+	for _, pattern := range m.cfg.Key.QueryAllowlist {
+		if matchWildcard(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchWildcard reports whether s equals pattern, or starts with it when
+// pattern ends with a "*".
+func matchWildcard(pattern, s string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(s, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return pattern == s
+}
+
+// getCache returns the provider to use, which is the fallback one, if any,
+// while the main one is unavailable.
 func (m *cache) getCache() (CacheSystem, error) {
-	if m.cacheAvailable {
-		return &m.cache, nil
+	if m.available() {
+		return m.cache, nil
+	}
+
+	if m.fallback != nil {
+		return m.fallback, nil
 	}
 
-	return &m.cache, errors.New("Cache not available")
+	return m.cache, errors.New("Cache not available")
+}
+
+func (m *cache) available() bool {
+	m.availableMu.RLock()
+	defer m.availableMu.RUnlock()
+
+	return m.cacheAvailable
+}
+
+// setAvailable records the availability of the main provider and reports
+// whether it changed.
+func (m *cache) setAvailable(available bool) bool {
+	m.availableMu.Lock()
+	defer m.availableMu.Unlock()
+
+	changed := m.cacheAvailable != available
+	m.cacheAvailable = available
+
+	return changed
 }
 
 func (m *cache) handleCacheErrorAndExit(err error, w http.ResponseWriter, r *http.Request) bool {
-	log.Println(err)
-	if strings.Contains(err.Error(), "connect: connection refused") {
-		//m.cacheAvailable = false
-		rw := &responseWriter{ResponseWriter: w}
-		m.next.ServeHTTP(rw, r)
+	if m.cacheError(err) {
+		m.bypass(w, r)
 
 		return true
 	}
@@ -436,14 +1253,77 @@ func (m *cache) handleCacheErrorAndExit(err error, w http.ResponseWriter, r *htt
 	return false
 }
 
-func (m *cache) cacheHealthcheck(interval time.Duration) {
+// bypass sends a request straight to the backend because the cache is
+// unavailable.
+func (m *cache) bypass(w http.ResponseWriter, r *http.Request) {
+	if m.cfg.AddStatusHeader {
+		w.Header().Set(cacheHeader, cacheUnavailableStatus)
+	}
+
+	m.next.ServeHTTP(w, r)
+}
+
+// cacheError logs a provider error and reports whether the cache cannot be
+// used for the request: the request is canceled, or the provider is
+// unavailable. An unreachable provider is considered unavailable until the
+// next healthcheck.
+func (m *cache) cacheError(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG %v", err)
+		}
+		return true
+	case errors.Is(err, api.ErrCircuitOpen):
+		if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG %v", err)
+		}
+		return true
+	}
+
+	log.Println(err)
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		if m.setAvailable(false) {
+			log.Printf("[Cache] %s: cache unavailable until the next healthcheck", m.name)
+		}
+	}
+
+	return errors.Is(err, provider.ErrUnavailable)
+}
+
+// cacheHealthcheck checks the availability of the main provider every
+// interval until ctx is done, and then stops the providers.
+func (m *cache) cacheHealthcheck(ctx context.Context, interval time.Duration) {
 	timer := time.NewTicker(interval)
 	defer timer.Stop()
 
-	for range timer.C {
-		m.cacheAvailable = m.cache.Check(true)
+	defer func() {
+		stopCache(m.cache)
+		stopCache(m.fallback)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		available := m.cache.Check(true)
+		if m.setAvailable(available) {
+			switch {
+			case available:
+				log.Printf("[Cache] %s: cache available again", m.name)
+			case m.fallback != nil:
+				log.Printf("[Cache] %s: cache unavailable, failing over to %s", m.name, m.cfg.Fallback)
+			default:
+				log.Printf("[Cache] %s: cache unavailable", m.name)
+			}
+		}
 		if m.cfg.Debug {
-			log.Printf("[Cache] DEBUG healthcheck: %v", m.cacheAvailable)
+			log.Printf("[Cache] DEBUG healthcheck: %v", available)
 		}
 	}
 }
@@ -452,22 +1332,199 @@ type responseWriter struct {
 	http.ResponseWriter
 	status int
 	body   []byte
+
+	// limit is the number of bytes of body captured, 0 for no limit. Once it
+	// is exceeded, the capture stops and overflow is set.
+	limit    int
+	overflow bool
+
+	// header stages the response headers until the status is known.
+	header      http.Header
+	wroteHeader bool
+	// hold reports, from the status and headers, whether the response is
+	// held back until commit instead of written through.
+	hold func(int, http.Header) bool
+	held bool
+}
+
+// newResponseWriter returns a responseWriter that captures up to limit bytes
+// of body and holds back the responses selected by hold.
+func newResponseWriter(w http.ResponseWriter, limit int, hold func(int, http.Header) bool) *responseWriter {
+	return &responseWriter{
+		ResponseWriter: w,
+		limit:          limit,
+		header:         w.Header().Clone(),
+		hold:           hold,
+	}
+}
+
+// finish decides what to do with the response if the backend did not write
+// anything.
+func (rw *responseWriter) finish() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// commit sends a held back response to r with the given ETag, without its
+// body when it matches the If-None-Match header of r, or as the ranges of
+// its Range header.
+func (rw *responseWriter) commit(r *http.Request, etag string) {
+	if !rw.held {
+		return
+	}
+
+	rw.copyHeader()
+	rw.ResponseWriter.Header().Set(etagHeader, etag)
+
+	if notModified(r, etag) {
+		rw.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data := cacheData{Status: rw.status, Headers: rw.ResponseWriter.Header(), Body: rw.body, Etag: etag}
+	if sendRange(rw.ResponseWriter, r, data) {
+		return
+	}
+
+	rw.ResponseWriter.WriteHeader(rw.status)
+	_, _ = rw.ResponseWriter.Write(rw.body)
+}
+
+// release sends a held back response to the client as is and writes the rest
+// of it through.
+func (rw *responseWriter) release() {
+	rw.held = false
+
+	rw.copyHeader()
+	rw.ResponseWriter.WriteHeader(rw.status)
+	_, _ = rw.ResponseWriter.Write(rw.body)
+}
+
+// copyHeader replaces the client response headers with the staged ones.
+func (rw *responseWriter) copyHeader() {
+	dst := rw.ResponseWriter.Header()
+	for k := range dst {
+		if _, ok := rw.header[k]; !ok {
+			dst.Del(k)
+		}
+	}
+	for k, v := range rw.header {
+		dst[k] = v
+	}
 }
 
 func (rw *responseWriter) Header() http.Header {
+	if rw.header != nil {
+		return rw.header
+	}
+
 	return rw.ResponseWriter.Header()
 }
 
 func (rw *responseWriter) Write(p []byte) (int, error) {
-	rw.body = append(rw.body, p...)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	// only held back responses and the ones of refreshes are captured
+	if rw.hold != nil && !rw.held {
+		return rw.ResponseWriter.Write(p)
+	}
+
+	if !rw.overflow && rw.limit > 0 && len(rw.body)+len(p) > rw.limit {
+		// server errors stay held back to be replaced by a stale entry
+		if rw.held && rw.status < http.StatusInternalServerError {
+			rw.release()
+		}
+		rw.overflow = true
+		rw.body = nil
+	}
+
+	if !rw.overflow {
+		rw.body = append(rw.body, p...)
+	}
+
+	if rw.held {
+		return len(p), nil
+	}
+
 	return rw.ResponseWriter.Write(p)
 }
 
 func (rw *responseWriter) WriteHeader(s int) {
+	if informational(s) {
+		if rw.header != nil {
+			rw.copyHeader()
+		}
+		rw.ResponseWriter.WriteHeader(s)
+		return
+	}
+
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
 	rw.status = s
+
+	// streams and bodies declared larger than the limit are not captured at
+	// all
+	if streamingResponse(s, rw.Header()) {
+		rw.overflow = true
+	} else if length, err := strconv.Atoi(rw.Header().Get("Content-Length")); err == nil && rw.limit > 0 && length > rw.limit {
+		rw.overflow = true
+	}
+
+	if rw.header != nil {
+		if rw.hold != nil && (!rw.overflow || s >= http.StatusInternalServerError) && rw.hold(s, rw.header) {
+			rw.held = true
+			return
+		}
+
+		rw.copyHeader()
+	}
+
 	rw.ResponseWriter.WriteHeader(s)
 }
 
+// discardWriter is a http.ResponseWriter that drops the body, used for
+// backend requests that are not tied to a client.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+// detachedContext keeps the values of its parent but is never canceled, so
+// background work can outlive the request that started it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
 func encodeKey(key string) string {
 	return base64.URLEncoding.EncodeToString([]byte(key))
 }
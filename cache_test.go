@@ -0,0 +1,714 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+	"github.com/igoooor/conteo-traefik-cache/provider/api"
+)
+
+func TestQueryKey(t *testing.T) {
+	cfg := CreateConfig()
+	m := &cache{cfg: cfg}
+
+	tests := map[string]string{
+		"/?b=2&a=1":             "a=1&b=2",
+		"/?a=2&b=1&a=1":         "a=2&a=1&b=1",
+		"/?tag=z&tag=a&id=1":    "id=1&tag=z&tag=a",
+		"/?a%5B%5D=2&a=1&a[]=1": "a=1&a%5B%5D=2&a[]=1",
+		"/?utm_source=x&b=1&a":  "a&b=1",
+	}
+
+	for target, want := range tests {
+		if got := m.queryKey(httptest.NewRequest(http.MethodGet, target, nil)); got != want {
+			t.Errorf("queryKey(%q) = %q, want %q", target, got, want)
+		}
+	}
+
+	cfg.Key.SortQuery = false
+	if got := m.queryKey(httptest.NewRequest(http.MethodGet, "/?b=2&a=1", nil)); got != "b=2&a=1" {
+		t.Errorf("unsorted queryKey = %q, want %q", got, "b=2&a=1")
+	}
+}
+
+func TestCacheKeyPath(t *testing.T) {
+	m := &cache{cfg: CreateConfig()}
+
+	tests := map[string]string{
+		"http://e.com/search?q=a":   "GET-e.com-/search?q=a",
+		"http://e.com/search%3Fq=a": "GET-e.com-/search%3Fq=a",
+		"http://e.com/a%20b":        "GET-e.com-/a%20b",
+		"http://e.com/caf%c3%a9":    "GET-e.com-/caf%C3%A9",
+		"http://e.com/a%23b":        "GET-e.com-/a%23b",
+	}
+
+	for target, want := range tests {
+		if got := m.cacheKey(httptest.NewRequest(http.MethodGet, target, nil)); got != want {
+			t.Errorf("cacheKey(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestJoinFlight(t *testing.T) {
+	m := &cache{cfg: CreateConfig(), flights: map[string]*flight{}}
+
+	f, leader := m.joinFlight("key")
+	if !leader {
+		t.Fatal("first request for a key does not lead its flight")
+	}
+	if g, leader := m.joinFlight("key"); leader || g != f {
+		t.Fatal("second request for a key does not follow the flight")
+	}
+	if _, leader := m.joinFlight("other"); !leader {
+		t.Fatal("request for another key does not lead its own flight")
+	}
+
+	m.leaveFlight("key", f)
+	select {
+	case <-f.done:
+	default:
+		t.Fatal("flight not done once its leader left")
+	}
+
+	if g, leader := m.joinFlight("key"); !leader || g == f {
+		t.Fatal("request after a finished flight does not lead a new one")
+	}
+}
+
+func TestWaitFlight(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.CoalesceTimeout = 1
+	m := &cache{cfg: cfg, flights: map[string]*flight{}}
+	ctx := context.Background()
+
+	f, _ := m.joinFlight("key")
+	f.data = &cacheData{Status: http.StatusOK}
+	m.leaveFlight("key", f)
+	if data := m.waitFlight(ctx, f); data != f.data {
+		t.Errorf("finished flight: data %v, want %v", data, f.data)
+	}
+
+	f, _ = m.joinFlight("uncacheable")
+	m.leaveFlight("uncacheable", f)
+	if data := m.waitFlight(ctx, f); data != nil {
+		t.Errorf("uncacheable flight: data %v, want nil", data)
+	}
+
+	f, _ = m.joinFlight("canceled")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if data := m.waitFlight(canceled, f); data != nil {
+		t.Errorf("canceled wait: data %v, want nil", data)
+	}
+
+	start := time.Now()
+	if data := m.waitFlight(ctx, f); data != nil || time.Since(start) < time.Second {
+		t.Errorf("wait timed out after %v with data %v", time.Since(start), data)
+	}
+}
+
+// slowBackend holds its first response until release is closed, and counts
+// the requests it gets.
+type slowBackend struct {
+	cacheControl string
+	started      chan struct{}
+	release      chan struct{}
+	calls        int32
+}
+
+func (b *slowBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&b.calls, 1) == 1 {
+		close(b.started)
+		<-b.release
+	}
+
+	w.Header().Set("Cache-Control", b.cacheControl)
+	_, _ = w.Write([]byte("body"))
+}
+
+func TestCoalesce(t *testing.T) {
+	const requests = 5
+
+	tests := []struct {
+		cacheControl string
+		calls        int32
+	}{
+		{cacheControl: "max-age=60", calls: 1},
+		// the followers fall back to their own backend request
+		{cacheControl: "no-store", calls: requests},
+	}
+
+	for _, test := range tests {
+		backend := &slowBackend{cacheControl: test.cacheControl, started: make(chan struct{}), release: make(chan struct{})}
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		cfg.CoalesceTimeout = 5
+		h, err := New(context.Background(), backend, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		bodies := make([]string, requests)
+		serve := func(i int) {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			bodies[i] = w.Body.String()
+		}
+
+		wg.Add(requests)
+		go serve(0)
+		<-backend.started
+		for i := 1; i < requests; i++ {
+			go serve(i)
+		}
+
+		// the followers wait for the leader instead of calling the backend
+		time.Sleep(50 * time.Millisecond)
+		if calls := atomic.LoadInt32(&backend.calls); calls != 1 {
+			t.Errorf("%s: %d backend requests before the leader is answered, want 1", test.cacheControl, calls)
+		}
+
+		close(backend.release)
+		wg.Wait()
+
+		if calls := atomic.LoadInt32(&backend.calls); calls != test.calls {
+			t.Errorf("%s: %d backend requests, want %d", test.cacheControl, calls, test.calls)
+		}
+		for i, body := range bodies {
+			if body != "body" {
+				t.Errorf("%s: request %d got %q", test.cacheControl, i, body)
+			}
+		}
+	}
+}
+
+// storeEntry stores data as the entry of a GET request to target, for a
+// minute.
+func storeEntry(t *testing.T, m *cache, target string, data cacheData) {
+	t.Helper()
+
+	key := m.cacheKey(httptest.NewRequest(http.MethodGet, target, nil))
+	if err := m.cache.Set(context.Background(), key, encodeEntry(data), time.Minute, time.Minute, data.Etag); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expiredEntry returns an entry with body that expired a second ago, served
+// stale until the given times, if not zero.
+func expiredEntry(body string, staleUntil, staleIfErrorUntil time.Time) cacheData {
+	now := time.Now()
+	data := cacheData{
+		Status:  http.StatusOK,
+		Headers: map[string][]string{"Content-Type": {"text/plain"}},
+		Body:    []byte(body),
+		Created: uint64(now.Add(-time.Minute).Unix()),
+		Etag:    `"old"`,
+		Expiry:  uint64(now.Add(-time.Second).Unix()),
+	}
+
+	if !staleUntil.IsZero() {
+		data.StaleUntil = uint64(staleUntil.Unix())
+	}
+	if !staleIfErrorUntil.IsZero() {
+		data.StaleIfErrorUntil = uint64(staleIfErrorUntil.Unix())
+	}
+
+	return data
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	const requests = 5
+
+	backend := &slowBackend{cacheControl: "max-age=60", started: make(chan struct{}), release: make(chan struct{})}
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), backend, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := h.(*cache)
+
+	storeEntry(t, m, "http://example.com/", expiredEntry("old", time.Now().Add(time.Minute), time.Time{}))
+
+	var wg sync.WaitGroup
+	wg.Add(requests)
+	for i := 0; i < requests; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+			if w.Code != http.StatusOK || w.Body.String() != "old" || w.Header().Get(cacheHeader) != cacheStaleStatus {
+				t.Errorf("request %d: %d %q, status %q", i, w.Code, w.Body.String(), w.Header().Get(cacheHeader))
+			}
+		}(i)
+	}
+
+	// the stale entry is served while a single refresh waits for the backend
+	wg.Wait()
+	<-backend.started
+	if calls := atomic.LoadInt32(&backend.calls); calls != 1 {
+		t.Errorf("%d backend requests while refreshing, want 1", calls)
+	}
+
+	close(backend.release)
+	waitRefresh(t, m)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	if w.Body.String() != "body" || !strings.HasPrefix(w.Header().Get(cacheHeader), "hit; ttl=") {
+		t.Errorf("after the refresh: %q, status %q", w.Body.String(), w.Header().Get(cacheHeader))
+	}
+	if calls := atomic.LoadInt32(&backend.calls); calls != 1 {
+		t.Errorf("%d backend requests, want 1", calls)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		entry *cacheData
+		// stale reports whether the entry replaces the backend error
+		stale bool
+	}{
+		{name: "within the window", entry: entryPtr(expiredEntry("old", time.Time{}, now.Add(time.Minute))), stale: true},
+		{name: "window passed", entry: entryPtr(expiredEntry("old", time.Time{}, now.Add(-time.Second)))},
+		{name: "no window", entry: entryPtr(expiredEntry("old", time.Time{}, time.Time{}))},
+		{name: "no entry"},
+	}
+
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("backend error"))
+		})
+
+		for _, test := range tests {
+			cfg := CreateConfig()
+			cfg.Provider = memoryProvider
+			h, err := New(context.Background(), next, cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.entry != nil {
+				storeEntry(t, h.(*cache), "http://example.com/", *test.entry)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+			switch {
+			case test.stale && (w.Code != http.StatusOK || w.Body.String() != "old" || w.Header().Get(cacheHeader) != cacheStaleStatus):
+				t.Errorf("%d %s: %d %q, status %q, want the stale entry", status, test.name, w.Code, w.Body.String(), w.Header().Get(cacheHeader))
+			case !test.stale && (w.Code != status || w.Body.String() != "backend error" ||
+				w.Header().Get("Content-Type") != "text/html" || w.Header().Get("Retry-After") != "10"):
+				t.Errorf("%d %s: %d %q, headers %v, want the backend error", status, test.name, w.Code, w.Body.String(), w.Header())
+			}
+		}
+	}
+}
+
+func entryPtr(data cacheData) *cacheData {
+	return &data
+}
+
+func TestMaxBodySize(t *testing.T) {
+	chunk := strings.Repeat("x", 60)
+
+	tests := []struct {
+		name   string
+		status int
+		chunks int
+		stale  bool
+		// cached reports whether the response is stored, and body is the one
+		// the client gets
+		cached bool
+		body   string
+	}{
+		{name: "within the limit", status: http.StatusOK, chunks: 1, cached: true, body: chunk},
+		{name: "over the limit", status: http.StatusOK, chunks: 3, body: strings.Repeat(chunk, 3)},
+		{name: "error over the limit", status: http.StatusInternalServerError, chunks: 3, body: strings.Repeat(chunk, 3)},
+		// server errors stay held back past the limit to be replaced
+		{name: "error over the limit with a stale entry", status: http.StatusInternalServerError, chunks: 3, stale: true, body: "old"},
+	}
+
+	for _, test := range tests {
+		var calls int32
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(test.status)
+			for i := 0; i < test.chunks; i++ {
+				_, _ = w.Write([]byte(chunk))
+			}
+		})
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		cfg.MaxBodySize = 100
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.stale {
+			storeEntry(t, h.(*cache), "http://example.com/", expiredEntry("old", time.Time{}, time.Now().Add(time.Minute)))
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+		status := test.status
+		if test.stale {
+			status = http.StatusOK
+		}
+		if w.Code != status || w.Body.String() != test.body || w.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("%s: %d, %d bytes, Content-Type %q", test.name, w.Code, w.Body.Len(), w.Header().Get("Content-Type"))
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+		want := int32(2)
+		if test.cached {
+			want = 1
+		}
+		if calls := atomic.LoadInt32(&calls); calls != want {
+			t.Errorf("%s: %d backend requests, want %d", test.name, calls, want)
+		}
+	}
+}
+
+func TestContentLengthOverLimit(t *testing.T) {
+	holds := 0
+	w := httptest.NewRecorder()
+	rw := newResponseWriter(w, 100, func(int, http.Header) bool {
+		holds++
+		return true
+	})
+
+	rw.Header().Set("Content-Length", "120")
+	rw.WriteHeader(http.StatusOK)
+
+	if !rw.overflow || rw.held || holds != 0 {
+		t.Fatalf("overflow %v, held %v after %d hold calls, want written through", rw.overflow, rw.held, holds)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "120" {
+		t.Errorf("header: %d, Content-Length %q", w.Code, w.Header().Get("Content-Length"))
+	}
+
+	// the body goes straight to the client without being captured
+	if _, err := rw.Write([]byte(strings.Repeat("x", 60))); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.Len() != 60 || len(rw.body) != 0 {
+		t.Errorf("%d bytes sent and %d captured after the first write, want 60 and 0", w.Body.Len(), len(rw.body))
+	}
+}
+
+func TestCacheStatusTier(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("body"))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = localProvider
+	cfg.Local.Path = t.TempDir()
+	cfg.L1.MaxSize = 1 << 20
+	cfg.AddStatusHeader = true
+
+	// a second instance sharing the files starts with an empty memory tier
+	instances := make([]http.Handler, 2)
+	for i := range instances {
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i] = h
+	}
+
+	tests := []struct {
+		instance int
+		status   string
+	}{
+		{instance: 0, status: cacheMissStatus},
+		{instance: 0, status: "; detail=l1"},
+		{instance: 1, status: "; detail=l2"},
+		{instance: 1, status: "; detail=l1"},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		instances[test.instance].ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+		if status := w.Header().Get(cacheHeader); !strings.HasSuffix(status, test.status) {
+			t.Errorf("request %d: Cache-Status %q, want %q", i, status, test.status)
+		}
+	}
+}
+
+// unavailableCache is a provider whose reads fail with err.
+type unavailableCache struct {
+	CacheSystem
+	err error
+}
+
+func (c unavailableCache) Get(context.Context, string, string) ([]byte, bool, error) {
+	return nil, false, c.err
+}
+
+func TestCircuitOpenBypass(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_, _ = w.Write([]byte("body"))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.AddStatusHeader = true
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := h.(*cache)
+	m.cache = unavailableCache{CacheSystem: m.cache, err: fmt.Errorf("get: %w", api.ErrCircuitOpen)}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	if w.Body.String() != "body" || w.Header().Get(cacheHeader) != cacheUnavailableStatus || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("body %q, Cache-Status %q, %d backend requests", w.Body.String(), w.Header().Get(cacheHeader), atomic.LoadInt32(&calls))
+	}
+	// the breaker decides when to try the provider again, not the healthcheck
+	if !m.available() {
+		t.Error("open circuit marked the cache unavailable")
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	refused := errors.New("connection refused")
+
+	tests := map[string]struct {
+		err error
+		// status is the Cache-Status of the request, and available whether
+		// the cache is still used by the next ones
+		status    string
+		available bool
+	}{
+		"dial":     {err: provider.Unavailable(&net.OpError{Op: "dial", Net: "tcp", Err: refused}), status: cacheUnavailableStatus},
+		"read":     {err: provider.Unavailable(&net.OpError{Op: "read", Net: "tcp", Err: refused}), status: cacheUnavailableStatus, available: true},
+		"canceled": {err: context.Canceled, status: cacheUnavailableStatus, available: true},
+		"other":    {err: errors.New("failed"), status: cacheMissStatus, available: true},
+	}
+
+	for name, test := range tests {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("body"))
+		})
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		cfg.AddStatusHeader = true
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := h.(*cache)
+		m.cache = unavailableCache{CacheSystem: m.cache, err: test.err}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+		if w.Body.String() != "body" || w.Header().Get(cacheHeader) != test.status {
+			t.Errorf("%s: body %q, Cache-Status %q, want %q", name, w.Body.String(), w.Header().Get(cacheHeader), test.status)
+		}
+		if m.available() != test.available {
+			t.Errorf("%s: available %v, want %v", name, m.available(), test.available)
+		}
+	}
+}
+
+func TestNotHeldNotCaptured(t *testing.T) {
+	w := httptest.NewRecorder()
+	rw := newResponseWriter(w, 100, func(int, http.Header) bool {
+		return false
+	})
+
+	rw.WriteHeader(http.StatusOK)
+	for i := 0; i < 2; i++ {
+		if _, err := rw.Write([]byte(strings.Repeat("x", 30))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w.Body.Len() != 60 || rw.body != nil || rw.overflow {
+		t.Errorf("%d bytes sent and %d captured, overflow %v, want 60 and 0", w.Body.Len(), len(rw.body), rw.overflow)
+	}
+}
+
+func TestCalculateEtag(t *testing.T) {
+	tests := []struct {
+		key, body string
+		same      bool
+	}{
+		{key: "GET-e.com-/", body: "body", same: true},
+		{key: "GET-e.com-/", body: "other body"},
+		{key: "GET-e.com-/other", body: "body"},
+	}
+
+	etag := calculateEtag("GET-e.com-/", []byte("body"))
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatalf("ETag %s is not a strong entity tag", etag)
+	}
+
+	for _, test := range tests {
+		if got := calculateEtag(test.key, []byte(test.body)); (got == etag) != test.same {
+			t.Errorf("calculateEtag(%q, %q) = %s, same as %s: %v", test.key, test.body, got, etag, !test.same)
+		}
+	}
+}
+
+func TestEtagAcrossRefreshes(t *testing.T) {
+	body := "body"
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(body))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := h.(*cache)
+
+	serve := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if etag != "" {
+			r.Header.Set(requestEtagHeader, etag)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("")
+	etag := w.Header().Get(etagHeader)
+	if w.Header().Get(cacheHeader) != cacheMissStatus || etag == "" {
+		t.Fatalf("miss: status %q, ETag %q", w.Header().Get(cacheHeader), etag)
+	}
+
+	if w = serve(""); w.Header().Get(etagHeader) != etag {
+		t.Errorf("hit: ETag %q, want %q", w.Header().Get(etagHeader), etag)
+	}
+
+	// an unchanged body fetched again keeps its ETag
+	key := m.cacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if err = m.cache.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if w = serve(etag); w.Code != http.StatusNotModified || w.Header().Get(etagHeader) != etag {
+		t.Errorf("refreshed miss: %d, ETag %q, want 304 with %q", w.Code, w.Header().Get(etagHeader), etag)
+	}
+
+	body = "new body"
+	if err = m.cache.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if w = serve(etag); w.Code != http.StatusOK || w.Header().Get(etagHeader) == etag {
+		t.Errorf("changed body: %d, ETag %q, want a new one", w.Code, w.Header().Get(etagHeader))
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch, etag string
+		match             bool
+	}{
+		{ifNoneMatch: `"a"`, etag: `"a"`, match: true},
+		{ifNoneMatch: `"a"`, etag: `"b"`},
+		{ifNoneMatch: `"b", "a"`, etag: `"a"`, match: true},
+		{ifNoneMatch: `"b","c"`, etag: `"a"`},
+		{ifNoneMatch: `*`, etag: `"a"`, match: true},
+		{ifNoneMatch: `W/"a"`, etag: `"a"`, match: true},
+		{ifNoneMatch: `"a"`, etag: `W/"a"`, match: true},
+		{ifNoneMatch: `W/"b", W/"a"`, etag: `W/"a"`, match: true},
+		{ifNoneMatch: ``, etag: `"a"`},
+		{ifNoneMatch: `*`, etag: ``},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(requestEtagHeader, test.ifNoneMatch)
+
+		if match := notModified(r, test.etag); match != test.match {
+			t.Errorf("notModified(%q, %q) = %v, want %v", test.ifNoneMatch, test.etag, match, test.match)
+		}
+
+		r.Header.Set(skipEtagHeader, "1")
+		if notModified(r, test.etag) {
+			t.Errorf("notModified(%q, %q) with %s", test.ifNoneMatch, test.etag, skipEtagHeader)
+		}
+	}
+}
+
+func TestParseEtags(t *testing.T) {
+	tests := map[string][]string{
+		``:                   {},
+		`"a"`:                {`"a"`},
+		` "a" , W/"b",,"c" `: {`"a"`, `W/"b"`, `"c"`},
+		`*`:                  {`*`},
+	}
+
+	for value, want := range tests {
+		if got := parseEtags(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseEtags(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestGetRequestEtag(t *testing.T) {
+	tests := map[string]string{
+		``:         "",
+		`"a"`:      `"a"`,
+		`W/"a"`:    `"a"`,
+		`"a", "b"`: "",
+		`*`:        "",
+		` "a" `:    `"a"`,
+	}
+
+	for value, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(requestEtagHeader, value)
+
+		if got := getRequestEtag(r); got != want {
+			t.Errorf("getRequestEtag(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
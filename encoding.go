@@ -0,0 +1,227 @@
+package conteo_traefik_cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+const (
+	acceptEncodingHeader  = "Accept-Encoding"
+	contentEncodingHeader = "Content-Encoding"
+
+	gzipEncoding     = "gzip"
+	identityEncoding = "identity"
+)
+
+// contentEncoding returns the content encoding of a response, or "" for
+// identity.
+func contentEncoding(header http.Header) string {
+	enc := strings.ToLower(strings.TrimSpace(header.Get(contentEncodingHeader)))
+	if enc == identityEncoding {
+		return ""
+	}
+
+	return enc
+}
+
+func noTransform(header http.Header) bool {
+	cc, err := cacheobject.ParseResponseCacheControl(header.Get("Cache-Control"))
+	return err == nil && cc.NoTransform
+}
+
+// encodingVariant reports whether a response must be stored per
+// Accept-Encoding, because its encoding cannot be normalized.
+func encodingVariant(header http.Header) bool {
+	switch contentEncoding(header) {
+	case "":
+		return false
+	case gzipEncoding:
+		return noTransform(header)
+	default:
+		return true
+	}
+}
+
+// compressible reports whether a content type is worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+
+	return false
+}
+
+// normalizeEncoding returns the headers and body of a response in the
+// configured storage encoding, when its encoding allows it. A strong ETag
+// sent by the backend is made weak when the body is transformed.
+func (m *cache) normalizeEncoding(header http.Header, body []byte) (http.Header, []byte) {
+	if encodingVariant(header) || noTransform(header) || len(body) == 0 {
+		return header, body
+	}
+
+	enc := contentEncoding(header)
+
+	var (
+		out []byte
+		err error
+	)
+
+	switch {
+	case enc == "" && m.cfg.Compression == gzipEncoding && compressible(header.Get("Content-Type")):
+		out, err = gzipBody(body)
+		enc = gzipEncoding
+	case enc == gzipEncoding && m.cfg.Compression == identityEncoding:
+		out, err = gunzipBody(body)
+		enc = ""
+	default:
+		return header, body
+	}
+
+	if err != nil {
+		return header, body
+	}
+
+	h := header.Clone()
+	if enc == "" {
+		h.Del(contentEncodingHeader)
+	} else {
+		h.Set(contentEncodingHeader, enc)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(out)))
+	addVary(h, acceptEncodingHeader)
+
+	if etag := h.Get(etagHeader); etag != "" {
+		h.Set(etagHeader, weakEtag(etag))
+	}
+
+	return h, out
+}
+
+// decodeForClient returns the body of a cached entry in an encoding accepted
+// by r, and whether it had to be decoded.
+func decodeForClient(r *http.Request, data cacheData) ([]byte, bool) {
+	header := http.Header(data.Headers)
+	if contentEncoding(header) != gzipEncoding || encodingVariant(header) || acceptsGzip(r) {
+		return data.Body, false
+	}
+
+	body, err := gunzipBody(data.Body)
+	if err != nil {
+		return data.Body, false
+	}
+
+	return body, true
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip. An
+// explicit gzip entry takes precedence over "*".
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, starQ := -1.0, -1.0
+
+	for _, value := range strings.Split(r.Header.Get(acceptEncodingHeader), ",") {
+		parts := strings.Split(value, ";")
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case gzipEncoding, "x-gzip":
+			if q > gzipQ {
+				gzipQ = q
+			}
+		case "*":
+			starQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+
+	return starQ > 0
+}
+
+// representationEtag weakens etag when the stored representation differs from
+// the one sent by the backend.
+func representationEtag(etag string, stored, origin http.Header) string {
+	if contentEncoding(stored) != contentEncoding(origin) {
+		return weakEtag(etag)
+	}
+
+	return etag
+}
+
+func weakEtag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return "W/" + etag
+}
+
+// addVary adds name to the Vary header, if not already listed.
+func addVary(header http.Header, name string) {
+	for _, v := range varyHeaders(header) {
+		if v == name || v == "*" {
+			return
+		}
+	}
+
+	header.Add("Vary", name)
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gunzipBody(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	return ioutil.ReadAll(zr)
+}
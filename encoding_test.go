@@ -0,0 +1,144 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider/memory"
+)
+
+func TestRevalidatedNormalizedEtag(t *testing.T) {
+	c, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &cache{cfg: CreateConfig()}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	key := m.cacheKey(r)
+
+	header, body := m.normalizeEncoding(http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Content-Type":  {"text/plain"},
+		"Etag":          {`"v1"`},
+	}, []byte(strings.Repeat("hello world ", 100)))
+
+	data, err := m.store(c, r, key, header, http.StatusOK, body)
+	if err != nil || data == nil || data.Etag != `W/"v1"` {
+		t.Fatalf("stored %+v, error %v", data, err)
+	}
+
+	data, err = m.revalidated(c, r, key, *data, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}})
+	if err != nil || data == nil || data.Etag != `W/"v1"` {
+		t.Fatalf("revalidated %+v, error %v", data, err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=0-3")
+	r.Header.Set("If-Range", `"v1"`)
+	w := httptest.NewRecorder()
+	m.sendCacheFile(w, *data, r, key)
+
+	if w.Code != http.StatusOK || w.Header().Get(etagHeader) != `W/"v1"` {
+		t.Errorf("If-Range with the backend ETag: %d, ETag %q", w.Code, w.Header().Get(etagHeader))
+	}
+}
+
+func TestNormalizedMissVary(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(strings.Repeat("hello world ", 100)))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+
+		if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != acceptEncodingHeader {
+			t.Errorf("%s: Vary %q", request, vary)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"GZIP":              true,
+		"x-gzip":            true,
+		"br, gzip;q=0.5":    true,
+		"gzip;q=0":          false,
+		"gzip; q=0.0":       false,
+		"gzip;q=invalid":    false,
+		"deflate, br":       false,
+		"identity":          false,
+		"*":                 true,
+		"*;q=0":             false,
+		"*;q=0, gzip":       true,
+		"gzip, *;q=0":       true,
+		"*, gzip;q=0":       false,
+		"gzip;q=0, x-gzip":  true,
+		"br;q=1, *;q=0.1":   true,
+		"gzipped, identity": false,
+	}
+
+	for header, accepted := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.Header.Set(acceptEncodingHeader, header)
+
+		if got := acceptsGzip(r); got != accepted {
+			t.Errorf("%q: accepts gzip %v, want %v", header, got, accepted)
+		}
+	}
+}
+
+func TestDecodeForClient(t *testing.T) {
+	body := strings.Repeat("hello world ", 100)
+	gzipped, err := gzipBody([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		header         http.Header
+		body           []byte
+		acceptEncoding string
+		// want is the body sent, and decoded whether it was gunzipped
+		want    string
+		decoded bool
+	}{
+		{name: "identity", header: http.Header{}, body: []byte(body), want: body},
+		{name: "gzip accepted", header: http.Header{contentEncodingHeader: {gzipEncoding}}, body: gzipped, acceptEncoding: "gzip", want: string(gzipped)},
+		{name: "gzip refused", header: http.Header{contentEncodingHeader: {gzipEncoding}}, body: gzipped, acceptEncoding: "*;q=0", want: body, decoded: true},
+		{name: "gzip not listed", header: http.Header{contentEncodingHeader: {gzipEncoding}}, body: gzipped, acceptEncoding: "br", want: body, decoded: true},
+		{name: "no transform", header: http.Header{contentEncodingHeader: {gzipEncoding}, "Cache-Control": {"no-transform"}}, body: gzipped, want: string(gzipped)},
+		{name: "other encoding", header: http.Header{contentEncodingHeader: {"br"}}, body: []byte("br"), want: "br"},
+		{name: "invalid gzip", header: http.Header{contentEncodingHeader: {gzipEncoding}}, body: []byte("invalid"), want: "invalid"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if test.acceptEncoding != "" {
+			r.Header.Set(acceptEncodingHeader, test.acceptEncoding)
+		}
+
+		got, decoded := decodeForClient(r, cacheData{Headers: test.header, Body: test.body})
+		if string(got) != test.want || decoded != test.decoded {
+			t.Errorf("%s: %d bytes, decoded %v, want %d bytes, decoded %v", test.name, len(got), decoded, len(test.want), test.decoded)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package conteo_traefik_cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"sort"
+)
+
+// Cache entries are stored in a binary envelope:
+//
+//	magic "CTC", version byte
+//	status uint16
+//	created, expiry, stale until, stale if error until uint64
+//	ETag string
+//	header count uvarint, each: name string, value count uvarint, values strings
+//	body length uvarint, body
+//	CRC-32C of all the above uint32
+//
+// Integers are little endian, strings are prefixed with their uvarint length.
+// Entries stored as JSON by earlier versions are still read.
+const (
+	entryMagic   = "CTC"
+	entryVersion = 1
+)
+
+var (
+	errEntryVersion  = errors.New("unknown cache entry version")
+	errEntryChecksum = errors.New("cache entry checksum mismatch")
+	errEntryFormat   = errors.New("malformed cache entry")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeEntry returns the binary envelope of data.
+func encodeEntry(data cacheData) []byte {
+	names := make([]string, 0, len(data.Headers))
+	size := len(entryMagic) + 1 + 2 + 4*8 + 4 + len(data.Etag) + len(data.Body) + 3*binary.MaxVarintLen64
+	for name, values := range data.Headers {
+		names = append(names, name)
+		size += len(name) + 2*binary.MaxVarintLen64
+		for _, v := range values {
+			size += len(v) + binary.MaxVarintLen64
+		}
+	}
+	sort.Strings(names)
+
+	b := make([]byte, 0, size)
+	b = append(b, entryMagic...)
+	b = append(b, entryVersion)
+
+	var n [8]byte
+	binary.LittleEndian.PutUint16(n[:2], uint16(data.Status))
+	b = append(b, n[:2]...)
+	for _, ts := range []uint64{data.Created, data.Expiry, data.StaleUntil, data.StaleIfErrorUntil} {
+		binary.LittleEndian.PutUint64(n[:], ts)
+		b = append(b, n[:]...)
+	}
+
+	b = appendString(b, data.Etag)
+
+	b = appendUvarint(b, uint64(len(names)))
+	for _, name := range names {
+		b = appendString(b, name)
+		b = appendUvarint(b, uint64(len(data.Headers[name])))
+		for _, v := range data.Headers[name] {
+			b = appendString(b, v)
+		}
+	}
+
+	b = appendUvarint(b, uint64(len(data.Body)))
+	b = append(b, data.Body...)
+
+	binary.LittleEndian.PutUint32(n[:4], crc32.Checksum(b, castagnoli))
+
+	return append(b, n[:4]...)
+}
+
+// decodeEntry reads an entry stored in the binary envelope or as JSON.
+func decodeEntry(b []byte) (cacheData, error) {
+	var data cacheData
+
+	if !bytes.HasPrefix(b, []byte(entryMagic)) {
+		err := json.Unmarshal(b, &data)
+		return data, err
+	}
+
+	if len(b) < len(entryMagic)+1+4 {
+		return data, errEntryFormat
+	}
+	if b[len(entryMagic)] != entryVersion {
+		return data, errEntryVersion
+	}
+
+	payload, sum := b[:len(b)-4], b[len(b)-4:]
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(sum) {
+		return data, errEntryChecksum
+	}
+
+	r := entryReader{b: payload[len(entryMagic)+1:]}
+
+	data.Status = int(r.uint16())
+	data.Created = r.uint64()
+	data.Expiry = r.uint64()
+	data.StaleUntil = r.uint64()
+	data.StaleIfErrorUntil = r.uint64()
+	data.Etag = r.string()
+
+	count := r.uvarint()
+	if count > uint64(len(r.b)) {
+		return data, errEntryFormat
+	}
+	data.Headers = make(map[string][]string, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		name := r.string()
+
+		n := r.uvarint()
+		if n > uint64(len(r.b)) {
+			return data, errEntryFormat
+		}
+		values := make([]string, 0, n)
+		for j := uint64(0); j < n && r.err == nil; j++ {
+			values = append(values, r.string())
+		}
+		data.Headers[name] = values
+	}
+
+	data.Body = r.bytes()
+
+	if r.err == nil && len(r.b) != 0 {
+		return data, errEntryFormat
+	}
+
+	return data, r.err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var n [binary.MaxVarintLen64]byte
+	return append(b, n[:binary.PutUvarint(n[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// entryReader reads the fields of an envelope, recording the first error.
+type entryReader struct {
+	b   []byte
+	err error
+}
+
+func (r *entryReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = errEntryFormat
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+
+	return v
+}
+
+func (r *entryReader) uint16() uint16 {
+	if v := r.next(2); v != nil {
+		return binary.LittleEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *entryReader) uint64() uint64 {
+	if v := r.next(8); v != nil {
+		return binary.LittleEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *entryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errEntryFormat
+		return 0
+	}
+	r.b = r.b[n:]
+
+	return v
+}
+
+func (r *entryReader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.err = errEntryFormat
+		return nil
+	}
+
+	return r.next(int(n))
+}
+
+func (r *entryReader) string() string {
+	return string(r.bytes())
+}
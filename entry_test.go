@@ -0,0 +1,151 @@
+package conteo_traefik_cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testEntry(body []byte) cacheData {
+	return cacheData{
+		Status: 200,
+		Headers: map[string][]string{
+			"Content-Type": {"text/html; charset=utf-8"},
+			"Etag":         {`"abc"`},
+			"Set-Cookie":   {"a=1", "b=2"},
+		},
+		Body:              body,
+		Created:           1600000000,
+		Etag:              `"abc"`,
+		Expiry:            1600000060,
+		StaleUntil:        1600000120,
+		StaleIfErrorUntil: 1600000180,
+	}
+}
+
+func TestEntryRoundTrip(t *testing.T) {
+	entries := []cacheData{
+		testEntry([]byte("<p>hello</p>")),
+		testEntry(bytes.Repeat([]byte{0, 1, 2, 255}, 1000)),
+		{Status: 204, Headers: map[string][]string{}, Body: []byte{}},
+	}
+
+	for _, data := range entries {
+		got, err := decodeEntry(encodeEntry(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, data) {
+			t.Errorf("decoded %+v, want %+v", got, data)
+		}
+	}
+}
+
+func TestEntryStableEncoding(t *testing.T) {
+	data := testEntry([]byte("body"))
+
+	if !bytes.Equal(encodeEntry(data), encodeEntry(data)) {
+		t.Error("encoding depends on the header map order")
+	}
+}
+
+func TestEntryTruncated(t *testing.T) {
+	b := encodeEntry(testEntry([]byte("<p>hello</p>")))
+
+	for i := 0; i < len(b); i++ {
+		if _, err := decodeEntry(b[:i]); err == nil {
+			t.Fatalf("entry truncated to %d bytes decoded", i)
+		}
+	}
+}
+
+func TestEntryBitFlip(t *testing.T) {
+	b := encodeEntry(testEntry([]byte("<p>hello</p>")))
+
+	for i := len(entryMagic); i < len(b); i++ {
+		for bit := uint(0); bit < 8; bit++ {
+			corrupt := append([]byte{}, b...)
+			corrupt[i] ^= 1 << bit
+
+			_, err := decodeEntry(corrupt)
+			if i == len(entryMagic) && !errors.Is(err, errEntryVersion) {
+				t.Fatalf("version flip %d: error %v", bit, err)
+			}
+			if i > len(entryMagic) && !errors.Is(err, errEntryChecksum) {
+				t.Fatalf("byte %d bit %d flipped: error %v", i, bit, err)
+			}
+		}
+	}
+}
+
+func TestEntryLegacyJSON(t *testing.T) {
+	data := testEntry([]byte("<p>hello</p>"))
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeEntry(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Errorf("decoded %+v, want %+v", got, data)
+	}
+
+	if _, err = decodeEntry(b[:len(b)/2]); err == nil {
+		t.Error("truncated JSON entry decoded")
+	}
+}
+
+func benchmarkEntry() cacheData {
+	return testEntry(bytes.Repeat([]byte("<p>hello world</p>"), 2000))
+}
+
+func BenchmarkEncodeEntry(b *testing.B) {
+	data := benchmarkEntry()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_ = encodeEntry(data)
+	}
+}
+
+func BenchmarkEncodeEntryJSON(b *testing.B) {
+	data := benchmarkEntry()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = json.Marshal(data)
+	}
+}
+
+func BenchmarkDecodeEntry(b *testing.B) {
+	encoded := encodeEntry(benchmarkEntry())
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeEntry(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeEntryJSON(b *testing.B) {
+	encoded, err := json.Marshal(benchmarkEntry())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeEntry(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package conteo_traefik_cache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider/api"
+	"github.com/igoooor/conteo-traefik-cache/provider/local"
+	"github.com/igoooor/conteo-traefik-cache/provider/memory"
+	"github.com/igoooor/conteo-traefik-cache/provider/tiered"
+)
+
+// Storage providers.
+const (
+	apiProvider    = "api"
+	localProvider  = "local"
+	memoryProvider = "memory"
+)
+
+// APIConfig configures the api provider, which stores the responses on a
+// cache server.
+type APIConfig struct {
+	// URL is the base URL of the cache server, Path if empty.
+	URL string `json:"url" yaml:"url" toml:"url"`
+	// BreakerThreshold is the number of consecutive failed calls to the cache
+	// server after which it is not called for BreakerCooldown seconds.
+	// 0 disables the circuit breaker.
+	BreakerThreshold int `json:"breakerThreshold" yaml:"breakerThreshold" toml:"breakerThreshold"`
+	BreakerCooldown  int `json:"breakerCooldown" yaml:"breakerCooldown" toml:"breakerCooldown"`
+	// DialTimeout, ReadTimeout and Timeout are the number of milliseconds to
+	// wait for a connection to the cache server, for its response headers, and
+	// for a whole call. 0 means no limit.
+	DialTimeout int `json:"dialTimeout" yaml:"dialTimeout" toml:"dialTimeout"`
+	ReadTimeout int `json:"readTimeout" yaml:"readTimeout" toml:"readTimeout"`
+	Timeout     int `json:"timeout" yaml:"timeout" toml:"timeout"`
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle connections kept
+	// open for IdleConnTimeout milliseconds.
+	MaxIdleConns        int `json:"maxIdleConns" yaml:"maxIdleConns" toml:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost" yaml:"maxIdleConnsPerHost" toml:"maxIdleConnsPerHost"`
+	IdleConnTimeout     int `json:"idleConnTimeout" yaml:"idleConnTimeout" toml:"idleConnTimeout"`
+	// TLS configures the connections to an https cache server.
+	TLS APITLSConfig `json:"tls" yaml:"tls" toml:"tls"`
+	// Socket is the path of the unix domain socket the cache server listens
+	// on, instead of the host of URL.
+	Socket string `json:"socket" yaml:"socket" toml:"socket"`
+	// Token is sent as a bearer token to the cache server.
+	Token string `json:"token" yaml:"token" toml:"token"`
+	// Secret signs the calls to the cache server with HMAC-SHA256.
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	// Compression is the encoding, "gzip" or "deflate", of the entries of at
+	// least CompressionThreshold bytes sent to the cache server. Empty
+	// disables the compression.
+	Compression          string `json:"compression" yaml:"compression" toml:"compression"`
+	CompressionThreshold int    `json:"compressionThreshold" yaml:"compressionThreshold" toml:"compressionThreshold"`
+}
+
+// APITLSConfig configures the TLS connections to the cache server.
+type APITLSConfig struct {
+	// CA is the PEM file of the certificate authorities verifying the cache
+	// server, the system ones if empty.
+	CA string `json:"ca" yaml:"ca" toml:"ca"`
+	// Cert and Key are the PEM files of the client certificate, for mutual
+	// TLS.
+	Cert               string `json:"cert" yaml:"cert" toml:"cert"`
+	Key                string `json:"key" yaml:"key" toml:"key"`
+	ServerName         string `json:"serverName" yaml:"serverName" toml:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" yaml:"insecureSkipVerify" toml:"insecureSkipVerify"`
+}
+
+// LocalConfig configures the local provider, which stores the responses on
+// disk.
+type LocalConfig struct {
+	// Path is the cache directory, Path if empty.
+	Path string `json:"path" yaml:"path" toml:"path"`
+}
+
+// MemoryConfig configures the memory provider, which stores the responses in
+// the memory of Traefik.
+type MemoryConfig struct {
+	// MaxSize is the number of bytes stored before the least recently used
+	// entries are evicted. 0 disables the limit.
+	MaxSize int `json:"maxSize" yaml:"maxSize" toml:"maxSize"`
+}
+
+// L1Config configures the memory tier put in front of the provider.
+type L1Config struct {
+	// MaxSize is the number of bytes kept in memory, evicting the least
+	// recently used entries. 0 disables the memory tier.
+	MaxSize int `json:"maxSize" yaml:"maxSize" toml:"maxSize"`
+	// TTL is the maximum number of seconds an entry is kept in memory.
+	TTL int `json:"ttl" yaml:"ttl" toml:"ttl"`
+}
+
+// newCacheSystem builds the named storage provider.
+func newCacheSystem(cfg *Config, provider string) (CacheSystem, error) {
+	cleanup := time.Duration(cfg.Cleanup) * time.Second
+
+	switch provider {
+	case apiProvider:
+		url := cfg.API.URL
+		if url == "" {
+			url = cfg.Path
+		}
+
+		opts := api.Options{
+			BreakerThreshold:     cfg.API.BreakerThreshold,
+			BreakerCooldown:      time.Duration(cfg.API.BreakerCooldown) * time.Second,
+			DialTimeout:          time.Duration(cfg.API.DialTimeout) * time.Millisecond,
+			ReadTimeout:          time.Duration(cfg.API.ReadTimeout) * time.Millisecond,
+			Timeout:              time.Duration(cfg.API.Timeout) * time.Millisecond,
+			MaxIdleConns:         cfg.API.MaxIdleConns,
+			MaxIdleConnsPerHost:  cfg.API.MaxIdleConnsPerHost,
+			IdleConnTimeout:      time.Duration(cfg.API.IdleConnTimeout) * time.Millisecond,
+			Socket:               cfg.API.Socket,
+			Token:                cfg.API.Token,
+			Secret:               cfg.API.Secret,
+			Compression:          cfg.API.Compression,
+			CompressionThreshold: cfg.API.CompressionThreshold,
+		}
+
+		if t := cfg.API.TLS; t != (APITLSConfig{}) {
+			opts.TLS = &api.TLSOptions{
+				CA:                 t.CA,
+				Cert:               t.Cert,
+				Key:                t.Key,
+				ServerName:         t.ServerName,
+				InsecureSkipVerify: t.InsecureSkipVerify,
+			}
+		}
+
+		fc, err := api.NewFileCache(url, opts)
+		if err != nil {
+			return nil, err
+		}
+		return fc, nil
+	case localProvider:
+		path := cfg.Local.Path
+		if path == "" {
+			path = cfg.Path
+		}
+
+		fc, err := local.NewFileCache(path, cleanup, cfg.Memory)
+		if err != nil {
+			return nil, err
+		}
+		return fc, nil
+	case memoryProvider:
+		mc, err := memory.NewMemoryCache(cfg.MemoryCache.MaxSize, cleanup)
+		if err != nil {
+			return nil, err
+		}
+		return mc, nil
+	}
+
+	return nil, fmt.Errorf("unknown provider %q", provider)
+}
+
+// stopper is implemented by the providers running a background vacuum.
+type stopper interface {
+	Stop()
+}
+
+// stopCache stops the background work of cs, if any.
+func stopCache(cs CacheSystem) {
+	if s, ok := cs.(stopper); ok {
+		s.Stop()
+	}
+}
+
+// withL1 puts the configured memory tier, if any, in front of cs.
+func withL1(cfg *Config, cs CacheSystem) (CacheSystem, error) {
+	if cfg.L1.MaxSize == 0 {
+		return cs, nil
+	}
+
+	revalidate := time.Duration(cfg.Revalidate) * time.Second
+
+	tc, err := tiered.NewTieredCache(cs, cfg.L1.MaxSize, time.Duration(cfg.L1.TTL)*time.Second, time.Duration(cfg.Cleanup)*time.Second, func(val []byte) (time.Duration, bool) {
+		return entryRemaining(val, revalidate)
+	}, variantsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// entryRemaining returns how long the encoded entry b is stored by the
+// provider, until its stale and revalidation windows end, as set by store. It
+// returns false when b is not an entry, such as a Vary marker.
+func entryRemaining(b []byte, revalidate time.Duration) (time.Duration, bool) {
+	data, err := decodeEntry(b)
+	if err != nil {
+		return 0, false
+	}
+
+	until := time.Unix(int64(data.Expiry), 0)
+	for _, ts := range []uint64{data.StaleUntil, data.StaleIfErrorUntil} {
+		if t := time.Unix(int64(ts), 0); t.After(until) {
+			until = t
+		}
+	}
+	if t := time.Unix(int64(data.Expiry), 0).Add(revalidate); hasValidators(data) && t.After(until) {
+		until = t
+	}
+
+	return time.Until(until), true
+}
@@ -2,24 +2,106 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
 )
 
 // Cache DB implementation
 type FileCache struct {
-	path   string
-	status bool
+	path    string
+	status  bool
+	client  *http.Client
+	breaker *breaker
+	token   string
+	secret  string
+
+	compression          string
+	compressionThreshold int
+	// compressionOK reports whether the cache server advertised the
+	// compression in the Accept-Encoding header of its ping response.
+	compressionMu sync.RWMutex
+	compressionOK bool
+}
+
+// Options configures a FileCache.
+type Options struct {
+	// BreakerThreshold is the number of consecutive failed calls opening the
+	// circuit breaker. 0 disables the circuit breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open before
+	// letting a trial call through.
+	BreakerCooldown time.Duration
+
+	// DialTimeout limits the time to connect to the cache server,
+	// ReadTimeout the time to wait for its response headers, and Timeout the
+	// whole call, including reading the body. 0 means no limit.
+	DialTimeout time.Duration
+	ReadTimeout time.Duration
+	Timeout     time.Duration
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle connections kept
+	// open, for IdleConnTimeout. 0 means no limit, except that
+	// MaxIdleConnsPerHost then defaults to 2.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// TLS configures the connections to an https cache server.
+	TLS *TLSOptions
+	// Socket is the path of a unix domain socket the cache server listens
+	// on, instead of the host of its URL.
+	Socket string
+
+	// Token is sent as a bearer token with every call.
+	Token string
+	// Secret signs every call, see Signature.
+	Secret string
+
+	// Compression is the encoding, Gzip or Deflate, of the payloads of at
+	// least CompressionThreshold bytes sent to the cache server. Empty
+	// disables the compression.
+	Compression          string
+	CompressionThreshold int
 }
 
 // NewFileCache creates a new FileCache instance.
-func NewFileCache(path string) (*FileCache, error) {
+func NewFileCache(path string, opts Options) (*FileCache, error) {
+	if path == "" && opts.Socket != "" {
+		path = "http://unix"
+	}
+
+	switch opts.Compression {
+	case "", Gzip, Deflate:
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", opts.Compression)
+	}
+
+	client, err := newClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	fc := &FileCache{
-		path: strings.TrimSuffix(path, "/") + "/",
+		path:   strings.TrimSuffix(path, "/") + "/",
+		client: client,
+		token:  opts.Token,
+		secret: opts.Secret,
+
+		compression:          opts.Compression,
+		compressionThreshold: opts.CompressionThreshold,
+		breaker: &breaker{
+			threshold: opts.BreakerThreshold,
+			cooldown:  opts.BreakerCooldown,
+		},
 	}
 
 	// temporarily disable local backup if api not available
@@ -27,13 +109,13 @@ func NewFileCache(path string) (*FileCache, error) {
 	if err != nil {
 		return nil, err
 	}*/
-	_, err := http.Get(fc.path)
-	fc.status = err == nil
+	fc.Check(true)
 
 	return fc, nil
 }
 
-// Check availability of cache system
+// Check availability of cache system, which must answer its ping endpoint
+// with a 2xx status
 func (c *FileCache) Check(refresh bool) bool {
 	if refresh {
 		// _, err := http.Get(c.path)
@@ -44,42 +126,111 @@ func (c *FileCache) Check(refresh bool) bool {
 			return false
 		}
 
-		client := &http.Client{}
 		req.Host = "ping"
+		if err = c.authorize(req); err != nil {
+			return false
+		}
+
+		response, err := c.client.Do(req)
+		if err != nil {
+			c.status = false
+			return false
+		}
 
-		_, err = client.Do(req)
-		c.status = err == nil
+		closeBody(response)
+		c.status = success(response)
+		if c.status {
+			c.setCompressionOK(acceptsEncoding(response.Header, c.compression))
+		}
 	}
 	return c.status
 }
 
+// do sends a request to the cache server, unless the circuit breaker is open,
+// and records its outcome: failing to get a response or getting a server error
+// counts as a failure, and is returned as a provider.ErrUnavailable error. The
+// caller must close the response body.
+func (c *FileCache) do(req *http.Request) (*http.Response, error) {
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	response, err := c.client.Do(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// the caller gave up, which says nothing about the cache server
+		c.breaker.release()
+		return nil, req.Context().Err()
+	case err != nil:
+		c.breaker.failure()
+		return nil, provider.Unavailable(err)
+	case response.StatusCode >= http.StatusInternalServerError:
+		c.breaker.failure()
+		closeBody(response)
+		return nil, provider.Unavailable(fmt.Errorf("cache server status: %d", response.StatusCode))
+	}
+
+	c.breaker.success()
+
+	return response, nil
+}
+
+func success(response *http.Response) bool {
+	return response.StatusCode >= 200 && response.StatusCode < 300
+}
+
 func encodeKey(key string) string {
 	return base64.URLEncoding.EncodeToString([]byte(key))
 }
 
-// Get returns the value for the given key.
-func (c *FileCache) Get(key string, etag string) ([]byte, bool, error) {
-	req, err := http.NewRequest(http.MethodGet, c.path+encodeKey(key), nil)
+func decodeKey(key string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Get returns the value for the given key, or reports that etag matches the
+// one it was stored with while the entry is fresh.
+func (c *FileCache) Get(ctx context.Context, key string, etag string) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.path+encodeKey(key), nil)
 	if err != nil {
 		return nil, false, err
 	}
 
 	req.Header.Set("X-Etag", etag)
-	client := &http.Client{}
+	c.acceptCompressed(req)
 
-	response, err := client.Do(req)
+	response, err := c.do(req)
 	if err != nil {
 		return nil, false, err
 	}
 
-	if response.StatusCode != http.StatusOK {
-		if response.StatusCode == http.StatusNotModified {
-			return nil, true, nil
-		}
-		return nil, false, nil
+	defer closeBody(response)
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, true, nil
+	case http.StatusNotFound:
+		return nil, false, provider.ErrNotFound
+	default:
+		return nil, false, fmt.Errorf("unexpected status getting entry: %d", response.StatusCode)
 	}
 
-	responseData, err := ioutil.ReadAll(response.Body)
+	responseData, err := readBody(response)
+	if err == nil {
+		responseData, err = provider.Open(responseData)
+	}
+	if errors.Is(err, provider.ErrCorrupt) {
+		_ = c.Delete(ctx, key)
+	}
 	if err != nil {
 		return nil, false, err
 	}
@@ -88,31 +239,152 @@ func (c *FileCache) Get(key string, etag string) ([]byte, bool, error) {
 }
 
 // Delete deletes the given key from the cache.
-func (c *FileCache) Delete(key string) {
-	req, err := http.NewRequest(http.MethodDelete, c.path+encodeKey(key), nil)
+func (c *FileCache) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.path+encodeKey(key), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.do(req)
 	if err != nil {
-		return
+		return err
 	}
 
-	client := &http.Client{}
-	client.Do(req)
+	closeBody(response)
+
+	if !success(response) && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status deleting entry: %d", response.StatusCode)
+	}
+
+	return nil
 }
 
-// Set sets the value for the given key.
-func (c *FileCache) Set(key string, val []byte, expiry time.Duration, etag string) error {
-	req, err := http.NewRequest(http.MethodPut, c.path+encodeKey(key), strings.NewReader(string(val)))
+// Set sets the value for the given key. The entry is fresh for expiry and is
+// kept by the cache server for ttl, which may be longer to allow serving it
+// stale.
+func (c *FileCache) Set(ctx context.Context, key string, val []byte, expiry, ttl time.Duration, etag string) error {
+	payload, encoding, err := c.compress(provider.Seal(val))
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("X-TTL", strconv.Itoa(int(expiry.Seconds())))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.path+encodeKey(key), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	req.Header.Set("X-TTL", strconv.Itoa(int(ttl.Seconds())))
+	req.Header.Set("X-Fresh-TTL", strconv.Itoa(int(expiry.Seconds())))
 	req.Header.Set("X-Etag", etag)
-	client := &http.Client{}
 
-	_, err = client.Do(req)
+	response, err := c.do(req)
 	if err != nil {
 		return err
 	}
 
+	closeBody(response)
+
+	if !success(response) {
+		return fmt.Errorf("unexpected status setting entry: %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// Tag records key under each of the given tags, for ttl.
+func (c *FileCache) Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.path+"_tags/"+encodeKey(key), nil)
+	if err != nil {
+		return err
+	}
+
+	encoded := make([]string, len(tags))
+	for i, tag := range tags {
+		encoded[i] = encodeKey(tag)
+	}
+
+	req.Header.Set("X-Tags", strings.Join(encoded, " "))
+	req.Header.Set("X-TTL", strconv.Itoa(int(ttl.Seconds())))
+
+	response, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	closeBody(response)
+
+	if !success(response) {
+		return fmt.Errorf("unexpected status tagging entry: %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// PurgeTag deletes every entry recorded under the given tag.
+func (c *FileCache) PurgeTag(ctx context.Context, tag string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.path+"_tags/"+encodeKey(tag), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	closeBody(response)
+
+	if !success(response) && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status purging tag: %d", response.StatusCode)
+	}
+
 	return nil
 }
+
+// Keys returns every key starting with the given prefix.
+func (c *FileCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	query := url.Values{"prefix": []string{encodeKey(prefix)}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.path+"_keys?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.acceptCompressed(req)
+
+	response, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeBody(response)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status listing keys: %d", response.StatusCode)
+	}
+
+	responseData, err := readBody(response)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, encoded := range strings.Split(string(responseData), "\n") {
+		if encoded == "" {
+			continue
+		}
+
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", encoded, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
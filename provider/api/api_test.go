@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+func TestGetChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	ts, srv := newTestServer(t)
+
+	c, err := NewFileCache(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "key", []byte("value"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	val, _ := ts.entry("key")
+	val[len(val)-1] ^= 1
+
+	if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, provider.ErrCorrupt) {
+		t.Fatalf("error %v, want %v", err, provider.ErrCorrupt)
+	}
+	if val, _ := ts.entry("key"); val != nil {
+		t.Error("corrupt entry not deleted")
+	}
+}
+
+func TestGetTruncatedBody(t *testing.T) {
+	var deletes int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			atomic.AddInt32(&deletes, 1)
+			return
+		}
+		if r.URL.Path == "/ping" {
+			return
+		}
+
+		// the connection is cut in the middle of the body
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+		_ = buf.Flush()
+		_ = conn.Close()
+	}))
+	defer srv.Close()
+
+	c, err := NewFileCache(srv.URL, Options{Compression: Gzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = c.Get(context.Background(), "key", "")
+	if !errors.Is(err, provider.ErrUnavailable) || errors.Is(err, provider.ErrCorrupt) {
+		t.Fatalf("error %v, want %v", err, provider.ErrUnavailable)
+	}
+	if atomic.LoadInt32(&deletes) != 0 {
+		t.Error("entry deleted after a transport error")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for status, want := range map[int]bool{
+		http.StatusOK:                  true,
+		http.StatusNoContent:           true,
+		http.StatusUnauthorized:        false,
+		http.StatusInternalServerError: false,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ping" {
+				t.Errorf("checked %s", r.URL.Path)
+			}
+			w.WriteHeader(status)
+		}))
+
+		c, err := NewFileCache(srv.URL, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if available := c.Check(true); available != want {
+			t.Errorf("ping status %d: available %v, want %v", status, available, want)
+		}
+
+		srv.Close()
+	}
+}
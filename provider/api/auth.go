@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+const (
+	// SignatureHeader holds the signature of a request to the cache server,
+	// of the form "t=<unix time>, n=<hex nonce>, s=<hex HMAC-SHA256>".
+	SignatureHeader = "X-Cache-Signature"
+	// DigestHeader holds the hex SHA-256 of a request body.
+	DigestHeader = "X-Content-Sha256"
+)
+
+// Errors returned by Verifier.Verify.
+var (
+	ErrUnauthorized     = errors.New("missing or invalid credentials")
+	ErrInvalidSignature = provider.ErrInvalidSignature
+	ErrExpiredSignature = provider.ErrExpiredSignature
+	ErrReplayedRequest  = provider.ErrReplayedRequest
+	ErrInvalidDigest    = errors.New("body does not match its digest")
+)
+
+// authorize adds the bearer token and the signature of req, if configured.
+func (c *FileCache) authorize(req *http.Request) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	if c.secret == "" {
+		return nil
+	}
+
+	body := []byte{}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+
+		body, err = ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	digest := sha256.Sum256(body)
+	req.Header.Set(DigestHeader, hex.EncodeToString(digest[:]))
+
+	var n [16]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(n[:])
+	signature := Signature([]byte(c.secret), timestamp, nonce, req)
+
+	req.Header.Set(SignatureHeader, "t="+timestamp+", n="+nonce+", s="+hex.EncodeToString(signature))
+
+	return nil
+}
+
+// Signature returns the HMAC-SHA256 of the timestamp, nonce, method, request
+// URI, which holds the encoded key, and the X-TTL, X-Fresh-TTL, X-Etag,
+// X-Tags, Content-Encoding and body digest headers of req, separated by
+// newlines.
+func Signature(secret []byte, timestamp, nonce string, req *http.Request) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(strings.Join([]string{
+		timestamp,
+		nonce,
+		req.Method,
+		req.URL.RequestURI(),
+		req.Header.Get("X-TTL"),
+		req.Header.Get("X-Fresh-TTL"),
+		req.Header.Get("X-Etag"),
+		req.Header.Get("X-Tags"),
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get(DigestHeader),
+	}, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// Verifier is the reference check of the requests to a cache server, to reject
+// unauthenticated, tampered or replayed calls.
+type Verifier struct {
+	// Token is the accepted bearer token. Requests carrying it are not
+	// required to be signed.
+	Token string
+	// Secret is the signature key.
+	Secret string
+	// MaxSkew is how far from the current time a signature timestamp may be.
+	MaxSkew time.Duration
+
+	nonces provider.Nonces
+}
+
+// NewVerifier returns a Verifier of bearer tokens and signatures. Either may be
+// empty to disable it.
+func NewVerifier(token, secret string, maxSkew time.Duration) *Verifier {
+	return &Verifier{
+		Token:   token,
+		Secret:  secret,
+		MaxSkew: maxSkew,
+	}
+}
+
+// Verify checks the bearer token or the signature of r, and that its body
+// matches the signed digest. The body of r is read and replaced.
+func (v *Verifier) Verify(r *http.Request) error {
+	if provider.BearerAuthorized(r, v.Token) {
+		return nil
+	}
+
+	if v.Secret == "" {
+		return ErrUnauthorized
+	}
+
+	fields := provider.SignatureFields(r.Header.Get(SignatureHeader))
+	timestamp, nonce, signature := fields["t"], fields["n"], fields["s"]
+
+	if timestamp == "" || nonce == "" || signature == "" {
+		return ErrUnauthorized
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(given, Signature([]byte(v.Secret), timestamp, nonce, r)) {
+		return ErrInvalidSignature
+	}
+
+	if err = provider.CheckTimestamp(timestamp, v.MaxSkew); err != nil {
+		return err
+	}
+
+	if err = v.checkDigest(r); err != nil {
+		return err
+	}
+
+	// a signature is valid for MaxSkew on both sides of its timestamp
+	return v.nonces.Use(nonce, 2*v.MaxSkew)
+}
+
+func (v *Verifier) checkDigest(r *http.Request) error {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		_ = r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	digest := sha256.Sum256(body)
+	given, err := hex.DecodeString(r.Header.Get(DigestHeader))
+	if err != nil || !hmac.Equal(given, digest[:]) {
+		return ErrInvalidDigest
+	}
+
+	return nil
+}
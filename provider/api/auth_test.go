@@ -0,0 +1,42 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	c := &FileCache{secret: "secret"}
+	v := NewVerifier("", "secret", time.Minute)
+
+	req, err := http.NewRequest(http.MethodPut, "http://cache/key", strings.NewReader("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-TTL", "60")
+
+	if err = c.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = v.Verify(req); err != nil {
+		t.Fatalf("signed request: %v", err)
+	}
+	if err = v.Verify(req); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("replayed request: error %v", err)
+	}
+
+	req.Header.Set("X-TTL", "3600")
+	if err = v.Verify(req); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered request: error %v", err)
+	}
+
+	req.Header.Set("X-TTL", "60")
+	req.Header.Set("Content-Encoding", Gzip)
+	if err = v.Verify(req); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered encoding: error %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+// GetMulti returns the values of the given keys in one call, leaving out the
+// missing ones, and deleting and leaving out the corrupt ones.
+//
+// The keys are sent to POST /_mget, one encoded key per line. The response is
+// a sequence of frames, each made of a "<encoded key> <length>\n" line
+// followed by the length bytes of the value.
+func (c *FileCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	response, err := c.batch(ctx, "_mget", keys, true)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeBody(response)
+
+	if !success(response) {
+		return nil, batchError("getting entries", response.StatusCode)
+	}
+
+	values := map[string][]byte{}
+	corrupt := []string{}
+
+	decoded, err := decodedBody(response)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(decoded)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if len(corrupt) > 0 {
+				_ = c.DeleteMulti(ctx, corrupt)
+			}
+			return values, nil
+		}
+		if err != nil {
+			return nil, provider.Unavailable(err)
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid frame %q", line)
+		}
+
+		key, err := decodeKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", fields[0], err)
+		}
+
+		length, err := strconv.Atoi(fields[1])
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid frame length %q", fields[1])
+		}
+
+		// the value grows with the bytes actually read, not with the length
+		// announced by the server
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, br, int64(length)); err != nil {
+			return nil, provider.Unavailable(err)
+		}
+
+		val, err := provider.Open(buf.Bytes())
+		if err != nil {
+			corrupt = append(corrupt, key)
+			continue
+		}
+
+		values[key] = val
+	}
+}
+
+// DeleteMulti deletes the given keys in one call, sent to POST /_mdelete, one
+// encoded key per line.
+func (c *FileCache) DeleteMulti(ctx context.Context, keys []string) error {
+	response, err := c.batch(ctx, "_mdelete", keys, false)
+	if err != nil {
+		return err
+	}
+
+	closeBody(response)
+
+	if !success(response) {
+		return batchError("deleting entries", response.StatusCode)
+	}
+
+	return nil
+}
+
+// batch posts the encoded keys to a batch endpoint, accepting a compressed
+// response for reads.
+func (c *FileCache) batch(ctx context.Context, endpoint string, keys []string, read bool) (*http.Response, error) {
+	var body bytes.Buffer
+	for _, key := range keys {
+		body.WriteString(encodeKey(key))
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.path+endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+	if read {
+		c.acceptCompressed(req)
+	}
+
+	return c.do(req)
+}
+
+// batchError returns the error of a batch call answered with status, which
+// is provider.ErrUnsupported for cache servers without batch endpoints.
+func batchError(op string, status int) error {
+	switch status {
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return fmt.Errorf("%w: status %d %s", provider.ErrUnsupported, status, op)
+	}
+
+	return fmt.Errorf("unexpected status %s: %d", op, status)
+}
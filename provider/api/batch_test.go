@@ -0,0 +1,260 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+// batchServer adds the batch endpoints to a test server, answering them with
+// status instead when it is set, and compressing the _mget responses when
+// they accept gzip.
+type batchServer struct {
+	*testServer
+	status int
+}
+
+func newBatchServer(t *testing.T) (*batchServer, *httptest.Server) {
+	bs := &batchServer{testServer: &testServer{
+		entries:        map[string][]byte{},
+		encoding:       map[string]string{},
+		acceptEncoding: acceptEncoding,
+	}}
+	srv := httptest.NewServer(bs)
+	t.Cleanup(srv.Close)
+
+	return bs, srv
+}
+
+func (s *batchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_mget" && r.URL.Path != "/_mdelete" {
+		s.testServer.ServeHTTP(w, r)
+		return
+	}
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out io.Writer = w
+	if r.URL.Path == "/_mget" && acceptsEncoding(r.Header, Gzip) {
+		w.Header().Set("Content-Encoding", Gzip)
+		gw := gzip.NewWriter(w)
+		defer func() {
+			_ = gw.Close()
+		}()
+		out = gw
+	}
+
+	sc := bufio.NewScanner(r.Body)
+	for sc.Scan() {
+		key := sc.Text()
+		if r.URL.Path == "/_mdelete" {
+			delete(s.entries, key)
+			continue
+		}
+		if val, ok := s.entries[key]; ok {
+			_, _ = fmt.Fprintf(out, "%s %d\n", key, len(val))
+			_, _ = out.Write(val)
+		}
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	ctx := context.Background()
+
+	for _, compression := range []string{"", Gzip} {
+		bs, srv := newBatchServer(t)
+		bs.setEntry("a", provider.Seal([]byte("value a")))
+		bs.setEntry("b b", provider.Seal([]byte("value\nb")))
+		bs.setEntry("empty", provider.Seal(nil))
+
+		c, err := NewFileCache(srv.URL, Options{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := c.GetMulti(ctx, []string{"a", "missing", "b b", "empty"})
+		if err != nil {
+			t.Fatalf("compression %q: %v", compression, err)
+		}
+
+		want := map[string][]byte{"a": []byte("value a"), "b b": []byte("value\nb"), "empty": {}}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("compression %q: values %q, want %q", compression, values, want)
+		}
+	}
+}
+
+func TestGetMultiCorrupt(t *testing.T) {
+	ctx := context.Background()
+	bs, srv := newBatchServer(t)
+
+	corrupt := provider.Seal([]byte("value"))
+	corrupt[len(corrupt)-1] ^= 1
+	bs.setEntry("corrupt", corrupt)
+	bs.setEntry("unsealed", []byte("value"))
+	bs.setEntry("key", provider.Seal([]byte("value")))
+
+	c, err := NewFileCache(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := c.GetMulti(ctx, []string{"corrupt", "unsealed", "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values["key"]) != "value" {
+		t.Errorf("values %q, want only key", values)
+	}
+
+	for _, key := range []string{"corrupt", "unsealed"} {
+		if val, _ := bs.entry(key); val != nil {
+			t.Errorf("corrupt entry %s not deleted", key)
+		}
+	}
+	if val, _ := bs.entry("key"); val == nil {
+		t.Error("valid entry deleted")
+	}
+}
+
+func TestGetMultiMalformed(t *testing.T) {
+	key := encodeKey("key")
+
+	tests := map[string]bool{
+		"no length\n":                    false,
+		key + " 5 extra\n":               false,
+		"!!! 5\nvalue":                   false,
+		key + " -1\n":                    false,
+		key + " five\nvalue":             false,
+		key + " 10\nvalue":               true,
+		key + " 99999999999\nvalue":      true,
+		key + " 5\nvalue" + key + " 5\n": true,
+		key + " 5":                       true,
+	}
+
+	for body, short := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/_mget" {
+				_, _ = io.WriteString(w, body)
+			}
+		}))
+
+		c, err := NewFileCache(srv.URL, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := c.GetMulti(context.Background(), []string{"key"})
+		switch {
+		case err == nil:
+			t.Errorf("%q: values %q, want an error", body, values)
+		case errors.Is(err, provider.ErrUnavailable) != short:
+			t.Errorf("%q: error %v, unavailable %v", body, err, !short)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	ctx := context.Background()
+	bs, srv := newBatchServer(t)
+
+	for _, key := range []string{"a", "b", "c"} {
+		bs.setEntry(key, provider.Seal([]byte("value")))
+	}
+
+	c, err := NewFileCache(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.DeleteMulti(ctx, []string{"a", "c", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, deleted := range map[string]bool{"a": true, "b": false, "c": true} {
+		if val, _ := bs.entry(key); (val == nil) != deleted {
+			t.Errorf("%s: deleted %v, want %v", key, val == nil, deleted)
+		}
+	}
+}
+
+func TestBatchUnsupported(t *testing.T) {
+	ctx := context.Background()
+
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		bs, srv := newBatchServer(t)
+		bs.status = status
+
+		c, err := NewFileCache(srv.URL, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = c.GetMulti(ctx, []string{"a", "b"}); !errors.Is(err, provider.ErrUnsupported) {
+			t.Errorf("status %d: get error %v, want %v", status, err, provider.ErrUnsupported)
+		}
+		if err = c.DeleteMulti(ctx, []string{"a", "b"}); !errors.Is(err, provider.ErrUnsupported) {
+			t.Errorf("status %d: delete error %v, want %v", status, err, provider.ErrUnsupported)
+		}
+	}
+
+	bs, srv := newBatchServer(t)
+	bs.status = http.StatusBadRequest
+
+	c, err := NewFileCache(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.DeleteMulti(ctx, []string{"a"}); err == nil || errors.Is(err, provider.ErrUnsupported) {
+		t.Errorf("status %d: delete error %v", bs.status, err)
+	}
+}
+
+// TestGetMultiKeys checks the request sent to the batch endpoint.
+func TestGetMultiKeys(t *testing.T) {
+	var body string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_mget" {
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewFileCache(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.GetMulti(context.Background(), []string{"a", "b/c?d"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := encodeKey("a") + "\n" + encodeKey("b/c?d") + "\n"; body != want {
+		t.Errorf("body %q, want %q", body, want)
+	}
+}
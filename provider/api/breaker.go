@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+// ErrCircuitOpen is returned without calling the cache server while the
+// circuit breaker is open. It matches provider.ErrUnavailable.
+var ErrCircuitOpen = provider.Unavailable(errors.New("cache server circuit open"))
+
+// Circuit breaker states.
+const (
+	closed = iota
+	open
+	halfOpen
+)
+
+// breaker is a circuit breaker opening after threshold consecutive failures.
+// Once open, calls fail fast for cooldown, then a single trial call is let
+// through in the half-open state: the circuit closes again if it succeeds and
+// reopens if it fails.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a call may be made.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = halfOpen
+		return true
+	case halfOpen:
+		// the trial call is in flight
+		return false
+	}
+
+	return true
+}
+
+// success records a successful call.
+func (b *breaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = closed
+	b.failures = 0
+}
+
+// release records a call abandoned by the caller, which lets another trial
+// call through in the half-open state.
+func (b *breaker) release() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == halfOpen {
+		b.state = open
+	}
+}
+
+// failure records a failed call.
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == halfOpen || b.failures >= b.threshold {
+		b.state = open
+		b.openedAt = time.Now()
+	}
+}
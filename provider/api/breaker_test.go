@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+// expire ends the cooldown of an open breaker.
+func (b *breaker) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.openedAt = time.Now().Add(-b.cooldown)
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 3, cooldown: time.Hour}
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("closed breaker refused call %d", i)
+		}
+		b.failure()
+	}
+
+	// a success resets the count of consecutive failures
+	b.success()
+	for i := 0; i < 2; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Fatal("breaker opened before threshold consecutive failures")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("open breaker allowed a call during its cooldown")
+	}
+
+	b.expire()
+	if !b.allow() {
+		t.Fatal("open breaker refused the trial call after its cooldown")
+	}
+	if b.allow() {
+		t.Fatal("half-open breaker allowed a second call during the trial")
+	}
+
+	// a failed trial reopens the circuit for another cooldown
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker allowed a call after a failed trial")
+	}
+
+	b.expire()
+	if !b.allow() {
+		t.Fatal("reopened breaker refused the trial call after its cooldown")
+	}
+
+	b.success()
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("closed breaker refused call %d after a successful trial", i)
+		}
+	}
+}
+
+func TestBreakerRelease(t *testing.T) {
+	b := &breaker{threshold: 1, cooldown: time.Hour}
+
+	b.failure()
+	b.expire()
+	if !b.allow() {
+		t.Fatal("open breaker refused the trial call after its cooldown")
+	}
+
+	// the trial was abandoned, another one is let through
+	b.release()
+	if !b.allow() {
+		t.Fatal("breaker refused a trial call after the previous one was released")
+	}
+	if b.allow() {
+		t.Fatal("half-open breaker allowed a second call during the trial")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := &breaker{}
+
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Error("disabled breaker refused a call")
+	}
+}
+
+func TestBreakerCalls(t *testing.T) {
+	ctx := context.Background()
+
+	var calls int32
+	status := int32(http.StatusInternalServerError)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	c, err := NewFileCache(srv.URL, Options{BreakerThreshold: 2, BreakerCooldown: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, provider.ErrUnavailable) || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: error %v", i, err)
+		}
+	}
+
+	if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("open circuit: error %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("%d calls to the cache server, want 2", n)
+	}
+
+	// a trial abandoned by its caller lets the next one through
+	c.breaker.expire()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err = c.Get(canceled, "key", ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled trial: error %v", err)
+	}
+
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Fatalf("trial after a canceled one: error %v", err)
+	}
+	if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Fatalf("closed circuit: error %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+// Payload encodings.
+const (
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// acceptEncoding is the Accept-Encoding header of the calls reading entries
+// when the payloads are compressed.
+const acceptEncoding = Gzip + ", " + Deflate
+
+// compress returns val encoded with the configured encoding, and the
+// encoding, or val as is with an empty encoding when it is smaller than the
+// threshold, does not shrink, or the cache server did not advertise the
+// encoding.
+func (c *FileCache) compress(val []byte) ([]byte, string, error) {
+	if c.compression == "" || len(val) < c.compressionThreshold || !c.compressionAccepted() {
+		return val, "", nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch c.compression {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Deflate:
+		// the deflate content coding is the zlib format, RFC 9110 8.4.1.2
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, "", fmt.Errorf("unsupported compression %q", c.compression)
+	}
+
+	if _, err := w.Write(val); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	if buf.Len() >= len(val) {
+		return val, "", nil
+	}
+
+	return buf.Bytes(), c.compression, nil
+}
+
+func (c *FileCache) compressionAccepted() bool {
+	c.compressionMu.RLock()
+	defer c.compressionMu.RUnlock()
+
+	return c.compressionOK
+}
+
+func (c *FileCache) setCompressionOK(ok bool) {
+	c.compressionMu.Lock()
+	defer c.compressionMu.Unlock()
+
+	c.compressionOK = ok
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header, sent by the cache
+// server with its ping response, lists the given encoding.
+func acceptsEncoding(header http.Header, encoding string) bool {
+	if encoding == "" {
+		return false
+	}
+
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), encoding) {
+				continue
+			}
+
+			// q=0 marks the encoding as not acceptable
+			for _, param := range parts[1:] {
+				name, value := splitParam(param)
+				if name == "q" {
+					q, err := strconv.ParseFloat(value, 64)
+					return err == nil && q > 0
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitParam(param string) (string, string) {
+	i := strings.Index(param, "=")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(param)), ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(param[:i])), strings.TrimSpace(param[i+1:])
+}
+
+// acceptCompressed asks for the compressed payloads as they are stored, if
+// payloads are compressed.
+func (c *FileCache) acceptCompressed(req *http.Request) {
+	if c.compression != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+}
+
+// decodedBody returns the decoded body of a response, which the caller must
+// still close.
+func decodedBody(response *http.Response) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return response.Body, nil
+	case Gzip:
+		return gzip.NewReader(response.Body)
+	case Deflate:
+		return zlib.NewReader(response.Body)
+	}
+
+	return nil, fmt.Errorf("unsupported content encoding %q", response.Header.Get("Content-Encoding"))
+}
+
+// readBody reads the decoded body of a response. Payloads with an invalid
+// encoding header or checksum are reported as provider.ErrCorrupt, and bodies
+// cut short, which may be the connection failing, as provider.ErrUnavailable.
+func readBody(response *http.Response) ([]byte, error) {
+	r, err := decodedBody(response)
+	if err == nil {
+		var b []byte
+		if b, err = ioutil.ReadAll(r); err == nil {
+			return b, nil
+		}
+	}
+
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, zlib.ErrHeader) ||
+		errors.Is(err, zlib.ErrChecksum) || errors.As(err, &corrupt) {
+		return nil, fmt.Errorf("%w: %v", provider.ErrCorrupt, err)
+	}
+
+	return nil, provider.Unavailable(err)
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+// testServer is a cache server keeping the entries in memory, with the
+// encoding they were sent with, and advertising acceptEncoding on its ping
+// endpoint.
+type testServer struct {
+	mu             sync.Mutex
+	entries        map[string][]byte
+	encoding       map[string]string
+	acceptEncoding string
+}
+
+func newTestServer(t *testing.T) (*testServer, *httptest.Server) {
+	ts := &testServer{entries: map[string][]byte{}, encoding: map[string]string{}, acceptEncoding: acceptEncoding}
+	srv := httptest.NewServer(ts)
+	t.Cleanup(srv.Close)
+
+	return ts, srv
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "ping" {
+		w.Header().Set("Accept-Encoding", s.acceptEncoding)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		val, ok := s.entries[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if enc := s.encoding[key]; enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+		}
+		_, _ = w.Write(val)
+	case http.MethodPut:
+		s.entries[key], _ = ioutil.ReadAll(r.Body)
+		s.encoding[key] = r.Header.Get("Content-Encoding")
+	case http.MethodDelete:
+		delete(s.entries, key)
+	}
+}
+
+func (s *testServer) entry(key string) ([]byte, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries[encodeKey(key)], s.encoding[encodeKey(key)]
+}
+
+func (s *testServer) setEntry(key string, val []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[encodeKey(key)] = val
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	long := []byte(strings.Repeat("hello world ", 100))
+
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		Gzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		Deflate: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		},
+	}
+
+	for encoding, newReader := range readers {
+		ts, srv := newTestServer(t)
+
+		c, err := NewFileCache(srv.URL, Options{Compression: encoding, CompressionThreshold: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for key, val := range map[string][]byte{"long": long, "short": []byte("hello")} {
+			if err = c.Set(ctx, key, val, time.Minute, time.Minute, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			got, _, err := c.Get(ctx, key, "")
+			if err != nil || !bytes.Equal(got, val) {
+				t.Errorf("%s %s: got %q, error %v", encoding, key, got, err)
+			}
+		}
+
+		if _, enc := ts.entry("short"); enc != "" {
+			t.Errorf("%s: short entry sent with encoding %q", encoding, enc)
+		}
+
+		// the stored payload is readable by a standard decoder
+		payload, enc := ts.entry("long")
+		if enc != encoding {
+			t.Fatalf("%s: long entry sent with encoding %q", encoding, enc)
+		}
+
+		r, err := newReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		sealed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if val, err := provider.Open(sealed); err != nil || !bytes.Equal(val, long) {
+			t.Errorf("%s: stored payload %q, error %v", encoding, val, err)
+		}
+	}
+}
+
+func TestCompressionCorrupt(t *testing.T) {
+	ctx := context.Background()
+	ts, srv := newTestServer(t)
+
+	c, err := NewFileCache(srv.URL, Options{Compression: Gzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "key", []byte(strings.Repeat("hello world ", 100)), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.setEntry("key", []byte("not a gzip stream at all"))
+
+	if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, provider.ErrCorrupt) {
+		t.Fatalf("error %v, want %v", err, provider.ErrCorrupt)
+	}
+	if val, _ := ts.entry("key"); val != nil {
+		t.Error("corrupt entry not deleted")
+	}
+}
+
+func TestCompressionNotAdvertised(t *testing.T) {
+	ctx := context.Background()
+	long := []byte(strings.Repeat("hello world ", 100))
+
+	for _, advertised := range []string{"", "deflate", "gzip;q=0, deflate"} {
+		ts, srv := newTestServer(t)
+		ts.acceptEncoding = advertised
+
+		c, err := NewFileCache(srv.URL, Options{Compression: Gzip})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.Set(ctx, "key", long, time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, enc := ts.entry("key"); enc != "" {
+			t.Errorf("advertised %q: entry sent with encoding %q", advertised, enc)
+		}
+
+		// a later ping advertising the encoding enables the compression
+		ts.mu.Lock()
+		ts.acceptEncoding = "deflate, GZIP;q=0.5"
+		ts.mu.Unlock()
+		c.Check(true)
+
+		if err = c.Set(ctx, "key", long, time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, enc := ts.entry("key"); enc != Gzip {
+			t.Errorf("advertised %q then gzip: entry sent with encoding %q", advertised, enc)
+		}
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	if _, err := NewFileCache("http://cache", Options{Compression: "br"}); err == nil {
+		t.Error("unsupported compression accepted")
+	}
+}
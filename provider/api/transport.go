@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxDrain is the number of bytes of a response body read before closing it,
+// beyond which the connection is not reused.
+const maxDrain = 64 << 10
+
+// TLSOptions configures the TLS connections to the cache server.
+type TLSOptions struct {
+	// CA is the PEM file of the certificate authorities verifying the server,
+	// the system ones if empty.
+	CA string
+	// Cert and Key are the PEM files of the client certificate, for mutual
+	// TLS.
+	Cert string
+	Key  string
+	// ServerName overrides the name the server certificate is verified for.
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// newClient returns the HTTP client shared by the calls to the cache server.
+func newClient(opts Options) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		ResponseHeaderTimeout: opts.ReadTimeout,
+		TLSHandshakeTimeout:   opts.DialTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if opts.Socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", opts.Socket)
+		}
+	}
+
+	if opts.TLS != nil {
+		config, err := tlsConfig(*opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+	}, nil
+}
+
+func tlsConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: opts.ServerName,
+		// #nosec G402 -- opt-in, for test servers
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CA != "" {
+		pem, err := ioutil.ReadFile(opts.CA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CA file")
+		}
+	}
+
+	if opts.Cert != "" || opts.Key != "" {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// closeBody drains and closes a response body, so that its connection can be
+// reused.
+func closeBody(response *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, maxDrain))
+	_ = response.Body.Close()
+}
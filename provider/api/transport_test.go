@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+func TestSocket(t *testing.T) {
+	ctx := context.Background()
+
+	// unix socket paths are short, t.TempDir may be too long
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	socket := filepath.Join(dir, "cache.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{entries: map[string][]byte{}, encoding: map[string]string{}, acceptEncoding: acceptEncoding}
+	srv := httptest.NewUnstartedServer(ts)
+	_ = srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	c, err := NewFileCache("", Options{Socket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Check(false) {
+		t.Fatal("cache server on the socket unavailable")
+	}
+	if err = c.Set(ctx, "key", []byte("value"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, err := c.Get(ctx, "key", ""); err != nil || string(val) != "value" {
+		t.Errorf("got %q, error %v", val, err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			return
+		}
+
+		// the headers of /slow-headers and the body of /slow-body are late
+		if r.URL.Path == "/"+encodeKey("slow-body") {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	tests := map[string]Options{
+		"slow-headers": {ReadTimeout: 50 * time.Millisecond},
+		"slow-body":    {Timeout: 50 * time.Millisecond},
+	}
+
+	for key, opts := range tests {
+		c, err := NewFileCache(srv.URL, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		_, _, err = c.Get(context.Background(), key, "")
+		if !errors.Is(err, provider.ErrUnavailable) {
+			t.Errorf("%s: error %v, want %v", key, err, provider.ErrUnavailable)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: timed out after %v", key, elapsed)
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		tls       TLSOptions
+		available bool
+	}{
+		"client certificate": {tls: TLSOptions{CA: ca, Cert: certFile, Key: keyFile}, available: true},
+		"insecure":           {tls: TLSOptions{InsecureSkipVerify: true, Cert: certFile, Key: keyFile}, available: true},
+		"no client cert":     {tls: TLSOptions{CA: ca}},
+		"unknown CA":         {tls: TLSOptions{Cert: certFile, Key: keyFile}},
+	}
+
+	for name, test := range tests {
+		opts := test.tls
+
+		c, err := NewFileCache(srv.URL, Options{TLS: &opts})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if available := c.Check(true); available != test.available {
+			t.Errorf("%s: available %v, want %v", name, available, test.available)
+		}
+	}
+}
+
+func TestTLSInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalid, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]TLSOptions{
+		"missing CA":   {CA: filepath.Join(dir, "missing.pem")},
+		"invalid CA":   {CA: invalid},
+		"missing key":  {Cert: certFile},
+		"invalid cert": {Cert: invalid, Key: keyFile},
+	}
+
+	for name, opts := range tests {
+		opts := opts
+		if _, err := NewFileCache("https://cache", Options{TLS: &opts}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// writeCertificate writes a self-signed client certificate and its key in dir
+// and returns their paths.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
@@ -0,0 +1,106 @@
+package provider
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of the signature checks.
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpiredSignature = errors.New("expired signature")
+	ErrReplayedRequest  = errors.New("replayed request")
+)
+
+// BearerAuthorized reports whether r carries token in a bearer Authorization
+// header, compared in constant time. An empty token authorizes nothing.
+func BearerAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+
+	return token != "" && strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// SignatureFields returns the fields of a signature header value of the form
+// "t=<unix time>, n=<nonce>, s=<signature>", by name.
+func SignatureFields(value string) map[string]string {
+	fields := map[string]string{}
+
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	return fields
+}
+
+// CheckTimestamp checks that a signature timestamp, a Unix time, is within
+// maxSkew of the current time.
+func CheckTimestamp(timestamp string, maxSkew time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return ErrExpiredSignature
+	}
+
+	return nil
+}
+
+// Nonces records the nonces of accepted signatures until the signatures
+// expire, to reject replayed requests. The zero value is ready to use.
+type Nonces struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	// queue holds the recorded nonces in the order they expire.
+	queue []usedNonce
+}
+
+// usedNonce is a nonce recorded until its signature expires.
+type usedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// Use records a nonce for ttl, and fails with ErrReplayedRequest if it is
+// already recorded.
+func (n *Nonces) Use(nonce string, ttl time.Duration) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.nonces == nil {
+		n.nonces = map[string]time.Time{}
+	}
+
+	now := time.Now()
+
+	// the nonces expire in the order they were recorded
+	i := 0
+	for ; i < len(n.queue) && now.After(n.queue[i].expires); i++ {
+		delete(n.nonces, n.queue[i].nonce)
+	}
+	n.queue = n.queue[i:]
+
+	if _, ok := n.nonces[nonce]; ok {
+		return ErrReplayedRequest
+	}
+
+	expires := now.Add(ttl)
+	n.nonces[nonce] = expires
+	n.queue = append(n.queue, usedNonce{nonce: nonce, expires: expires})
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNoncesExpiry(t *testing.T) {
+	var n Nonces
+
+	for _, nonce := range []string{"a", "b"} {
+		if err := n.Use(nonce, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	if err := n.Use("c", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.nonces) != 1 || len(n.queue) != 1 {
+		t.Errorf("%d nonces, %d queued after expiry, want 1", len(n.nonces), len(n.queue))
+	}
+}
+
+func TestNoncesReplay(t *testing.T) {
+	var n Nonces
+
+	if err := n.Use("a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Use("a", time.Minute); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("reused nonce: error %v, want %v", err, ErrReplayedRequest)
+	}
+}
+
+func TestBearerAuthorized(t *testing.T) {
+	tests := []struct {
+		header, token string
+		authorized    bool
+	}{
+		{header: "Bearer token", token: "token", authorized: true},
+		{header: "Bearer other", token: "token"},
+		{header: "Bearer token", token: ""},
+		{header: "Bearer ", token: ""},
+		{header: "token", token: "token"},
+		{header: "Basic token", token: "token"},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest(http.MethodGet, "http://cache/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", test.header)
+
+		if authorized := BearerAuthorized(r, test.token); authorized != test.authorized {
+			t.Errorf("%q with token %q: authorized %v", test.header, test.token, authorized)
+		}
+	}
+}
+
+func TestSignatureFields(t *testing.T) {
+	fields := SignatureFields("t=1, n=abc ,s=a=b, junk,")
+
+	if len(fields) != 3 || fields["t"] != "1" || fields["n"] != "abc" || fields["s"] != "a=b" {
+		t.Errorf("fields %q", fields)
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Now()
+
+	tests := map[string]error{
+		strconv.FormatInt(now.Unix(), 10):                      nil,
+		strconv.FormatInt(now.Add(-30*time.Second).Unix(), 10): nil,
+		strconv.FormatInt(now.Add(30*time.Second).Unix(), 10):  nil,
+		strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10):  ErrExpiredSignature,
+		strconv.FormatInt(now.Add(2*time.Minute).Unix(), 10):   ErrExpiredSignature,
+		"":    ErrInvalidSignature,
+		"1e9": ErrInvalidSignature,
+	}
+
+	for timestamp, want := range tests {
+		if err := CheckTimestamp(timestamp, time.Minute); !errors.Is(err, want) {
+			t.Errorf("CheckTimestamp(%q) = %v, want %v", timestamp, err, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// sealMagic starts the values sealed with a checksum. Its leading zero byte
+// never starts the values stored before checksums were added.
+const sealMagic = "\x00CRC"
+
+// sealSize is the size of the header of a sealed value: the magic followed by
+// the CRC-32C of the value, little endian.
+const sealSize = len(sealMagic) + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// legacyPrefixes start the values stored before checksums were added: the
+// JSON and binary entries, and the Vary markers.
+var legacyPrefixes = []string{"{", "CTC", "vary:"}
+
+// Seal returns val prefixed with its checksum, for the providers to store.
+func Seal(val []byte) []byte {
+	b := make([]byte, sealSize, sealSize+len(val))
+	copy(b, sealMagic)
+	binary.LittleEndian.PutUint32(b[len(sealMagic):], crc32.Checksum(val, castagnoli))
+
+	return append(b, val...)
+}
+
+// Open returns the value sealed in b, or ErrCorrupt when it does not match its
+// checksum. Values stored without a checksum are returned as they are, when
+// they start with one of the legacy prefixes, and are corrupt otherwise.
+func Open(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(sealMagic)) {
+		for _, prefix := range legacyPrefixes {
+			if bytes.HasPrefix(b, []byte(prefix)) {
+				return b, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w: missing checksum", ErrCorrupt)
+	}
+	if len(b) < sealSize {
+		return nil, fmt.Errorf("%w: truncated checksum", ErrCorrupt)
+	}
+
+	val := b[sealSize:]
+	if binary.LittleEndian.Uint32(b[len(sealMagic):sealSize]) != crc32.Checksum(val, castagnoli) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+
+	return val, nil
+}
@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	for _, val := range [][]byte{nil, []byte("value"), bytes.Repeat([]byte{0, 255}, 1000)} {
+		sealed := Seal(val)
+
+		got, err := Open(sealed)
+		if err != nil || !bytes.Equal(got, val) {
+			t.Errorf("Open(Seal(%q)) = %q, %v", val, got, err)
+		}
+
+		for i := 0; i < len(sealed); i++ {
+			corrupt := append([]byte{}, sealed...)
+			corrupt[i] ^= 1
+
+			if _, err = Open(corrupt); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("byte %d flipped: error %v", i, err)
+			}
+		}
+
+		if len(val) > 0 {
+			if _, err = Open(sealed[:len(sealed)-1]); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("truncated: error %v", err)
+			}
+		}
+	}
+}
+
+func TestOpenUnsealed(t *testing.T) {
+	for _, val := range []string{"{}", "CTC\x01", "vary:Accept"} {
+		if got, err := Open([]byte(val)); err != nil || string(got) != val {
+			t.Errorf("Open(%q) = %q, %v", val, got, err)
+		}
+	}
+
+	for _, val := range []string{"", "value", "\x1f\x8b\x08\x00", "\x01CRC"} {
+		if _, err := Open([]byte(val)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Open(%q): error %v", val, err)
+		}
+	}
+
+	if _, err := Open([]byte(sealMagic + "\x01")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated header: error %v", err)
+	}
+}
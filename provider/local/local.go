@@ -2,27 +2,45 @@
 package local
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
 )
 
 var errCacheMiss = errors.New("[Cache] DEBUG miss")
 
+// tagsDir is the directory, under the cache path, holding the tag indexes.
+const tagsDir = "_tags"
+
+// headerSize is the size of the fixed part of a cache file header: the expiry
+// timestamp followed by the length of the key stored after it.
+const headerSize = 12
+
 // Cache DB implementation
 type FileCache struct {
 	path   string
 	pm     *PathMutex
 	items  map[string][]byte
 	memory bool
+	// itemsMu guards items, shared by the paths of every key.
+	itemsMu sync.RWMutex
+
+	// done stops the vacuum, closed by Stop.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewFileCache creates a new file cache
@@ -40,6 +58,7 @@ func NewFileCache(path string, vacuum time.Duration, memory bool) (*FileCache, e
 		pm:     &PathMutex{Lock: map[string]*FileLock{}},
 		items:  map[string][]byte{},
 		memory: memory,
+		done:   make(chan struct{}),
 	}
 
 	go fc.vacuum(vacuum)
@@ -52,13 +71,27 @@ func (c *FileCache) Check(refresh bool) bool {
 	return true
 }
 
+// Stop stops removing expired files, so that the cache can be released.
+func (c *FileCache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
 func (c *FileCache) vacuum(interval time.Duration) {
 	timer := time.NewTicker(interval)
 	defer timer.Stop()
 
-	for range timer.C {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+		}
+
 		// log.Println(">>> vacuum file cache")
 		_ = filepath.Walk(c.path, c.vacuumFile)
+		_ = filepath.Walk(filepath.Join(c.path, tagsDir), c.vacuumTagFile)
 	}
 }
 
@@ -66,16 +99,18 @@ func (c *FileCache) vacuumFile(path string, info os.FileInfo, err error) error {
 	switch {
 	case err != nil:
 		return err
+	case info.IsDir() && path == filepath.Join(c.path, tagsDir):
+		return filepath.SkipDir
 	case info.IsDir():
 		return nil
 	}
 
-	mu := c.pm.MutexAt(filepath.Base(path))
+	mu := c.pm.MutexAt(path)
 	mu.Lock()
 	defer mu.Unlock()
 
 	data, err := readFile(path)
-	if err != nil {
+	if err != nil || len(data) < 8 {
 		return nil
 	}
 
@@ -84,6 +119,7 @@ func (c *FileCache) vacuumFile(path string, info os.FileInfo, err error) error {
 		return nil
 	}
 
+	c.deleteFromMemory(path)
 	_ = os.Remove(path)
 	return nil
 }
@@ -92,7 +128,9 @@ func (c *FileCache) readFromMemory(path string) ([]byte, bool) {
 	var data = []byte{}
 	if c.memory {
 		var ok bool
+		c.itemsMu.RLock()
 		data, ok = c.items[path]
+		c.itemsMu.RUnlock()
 		if ok {
 			// log.Printf(">>>>>>>>>>>>>>>>>>> in-memory cache hit")
 			return data, true
@@ -103,53 +141,154 @@ func (c *FileCache) readFromMemory(path string) ([]byte, bool) {
 }
 
 // Get returns the value for the given key
-func (c *FileCache) Get(key string, etag string) ([]byte, bool, error) {
-	mu := c.pm.MutexAt(key)
+func (c *FileCache) Get(ctx context.Context, key string, etag string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
 	mu.RLock()
 	defer mu.RUnlock()
 
-	p := keyPath(c.path, key)
 	var data = []byte{}
 	data, foundInMemory := c.readFromMemory(p)
 
 	if !foundInMemory {
-		if info, err := os.Stat(p); err != nil || info.IsDir() {
-			return nil, false, nil
-		}
-
 		var err error
 		data, err = readFile(p)
+		if errors.Is(err, errCacheMiss) {
+			return nil, false, provider.ErrNotFound
+		}
 		if err != nil {
-			return nil, false, err
+			return nil, false, provider.Unavailable(err)
 		}
 
 		// log.Printf(">>>>>>>>>>>>>>>>>>> file cache hit")
 	}
 
+	_, val, err := decodeFile(data)
+	if err == nil {
+		val, err = provider.Open(val)
+	}
+	if err != nil {
+		c.deleteFromMemory(p)
+		_ = os.Remove(p)
+		return nil, false, err
+	}
+
 	expires := time.Unix(int64(binary.LittleEndian.Uint64(data[:8])), 0)
 	if expires.Before(time.Now()) {
+		c.deleteFromMemory(p)
 		_ = os.Remove(p)
-		return nil, false, nil
+		return nil, false, provider.ErrNotFound
 	}
 
 	// store it back into memory
 	if c.memory && !foundInMemory {
-		c.items[p] = data
+		c.setInMemory(p, data)
 	}
 
-	return data[8:], false, nil
+	return val, false, nil
 }
 
-// Delete deletes the cache file
-func (c *FileCache) Delete(path string) {
-	mu := c.pm.MutexAt(filepath.Base(path))
+// Keys returns every key starting with the given prefix
+func (c *FileCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+
+	err := filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case info.IsDir() && path == filepath.Join(c.path, tagsDir):
+			return filepath.SkipDir
+		case info.IsDir():
+			return nil
+		}
+
+		key, err := readKey(path, info)
+		if err != nil {
+			return nil
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// readKey reads the key stored in the header of a cache file, rejecting a key
+// length the size of the file cannot hold.
+func readKey(path string, info os.FileInfo) (string, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var header [headerSize]byte
+	if _, err = io.ReadFull(f, header[:]); err != nil {
+		return "", err
+	}
+
+	size := int64(binary.LittleEndian.Uint32(header[8:]))
+	if size > info.Size()-headerSize {
+		return "", provider.ErrCorrupt
+	}
+
+	key := make([]byte, size)
+	if _, err = io.ReadFull(f, key); err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// decodeFile splits the content of a cache file into its key and value.
+func decodeFile(data []byte) (string, []byte, error) {
+	if len(data) < headerSize {
+		return "", nil, provider.ErrCorrupt
+	}
+
+	end := headerSize + int(binary.LittleEndian.Uint32(data[8:headerSize]))
+	if end > len(data) {
+		return "", nil, provider.ErrCorrupt
+	}
+
+	return string(data[headerSize:end]), data[end:], nil
+}
+
+// Delete deletes the cache file for the given key
+func (c *FileCache) Delete(ctx context.Context, key string) error {
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
 	mu.Lock()
 	defer mu.Unlock()
 
-	_, err := readFile(path)
-	if err == nil {
-		_ = os.Remove(path)
+	c.deleteFromMemory(p)
+
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting file: %w", err)
 	}
+
+	return nil
 }
 
 func (c *FileCache) deleteFile(path string, info os.FileInfo, err error) error {
@@ -160,11 +299,184 @@ func (c *FileCache) deleteFile(path string, info os.FileInfo, err error) error {
 		return nil
 	}
 
-	c.Delete(path)
+	mu := c.pm.MutexAt(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	c.deleteFromMemory(path)
+	_ = os.Remove(path)
+
+	return nil
+}
+
+// Tag records key in the index file of each of the given tags, for ttl
+func (c *FileCache) Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	expires := time.Now().Add(ttl).Unix()
+
+	for _, tag := range tags {
+		if err := c.tag(key, tag, expires); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tag appends key and its expiry time to the index file of tag. A key tagged
+// again is appended again, the duplicates are removed by vacuumTagFile.
+func (c *FileCache) tag(key, tag string, expires int64) error {
+	p := keyPath(filepath.Join(c.path, tagsDir), tag)
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("error creating tag path: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Clean(p), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating tag file: %w", err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if _, err = f.WriteString(strconv.FormatInt(expires, 10) + " " + key + "\n"); err != nil {
+		return fmt.Errorf("error writing tag file: %w", err)
+	}
+
+	return nil
+}
+
+// vacuumTagFile removes the expired and duplicate keys of a tag index file,
+// and the file once it is empty.
+func (c *FileCache) vacuumTagFile(path string, info os.FileInfo, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case info.IsDir():
+		return nil
+	}
+
+	mu := c.pm.MutexAt(path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	keys, lines, err := readTagFile(path)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now().Unix()
+
+	var b strings.Builder
+	for key, expires := range keys {
+		// keys indexed without their expiry are kept as long as their entry
+		if expires >= now || (expires == 0 && c.exists(key)) {
+			b.WriteString(strconv.FormatInt(expires, 10) + " " + key + "\n")
+		} else {
+			delete(keys, key)
+		}
+	}
+
+	switch {
+	case len(keys) == 0:
+		_ = os.Remove(path)
+	case len(keys) < lines:
+		_ = ioutil.WriteFile(path, []byte(b.String()), 0600)
+	}
 
 	return nil
 }
 
+// exists reports whether the cache file of key exists.
+func (c *FileCache) exists(key string) bool {
+	_, err := os.Stat(keyPath(c.path, key))
+
+	return err == nil
+}
+
+// PurgeTag deletes every cache file recorded under the given tag. The index
+// is only removed once every file is deleted, so that a failed purge can be
+// retried; otherwise the first error is returned, after trying every file.
+func (c *FileCache) PurgeTag(ctx context.Context, tag string) error {
+	p := keyPath(filepath.Join(c.path, tagsDir), tag)
+
+	// keys tagged meanwhile must not be dropped with the index
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	keys, _, err := readTagFile(p)
+	if err != nil {
+		return err
+	}
+
+	var first error
+	now := time.Now().Unix()
+	for key, expires := range keys {
+		if expires != 0 && expires < now {
+			continue
+		}
+		if err = c.Delete(ctx, key); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	if first != nil {
+		return first
+	}
+
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting tag file: %w", err)
+	}
+
+	return nil
+}
+
+// readTagFile returns the keys of a tag index file, with their latest expiry
+// time, 0 for the keys indexed before expiry times were recorded, and the
+// number of lines of the file.
+func readTagFile(path string) (map[string]int64, int, error) {
+	b, err := readFile(path)
+	if errors.Is(err, errCacheMiss) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := map[string]int64{}
+	lines := 0
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		lines++
+
+		expires, key := parseTagLine(line)
+		if e, ok := keys[key]; !ok || expires > e {
+			keys[key] = expires
+		}
+	}
+
+	return keys, lines, nil
+}
+
+// parseTagLine splits a "<expiry> <key>" line of a tag index file.
+func parseTagLine(line string) (int64, string) {
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		if expires, err := strconv.ParseInt(line[:i], 10, 64); err == nil {
+			return expires, line[i+1:]
+		}
+	}
+
+	return 0, line
+}
+
 func readFile(path string) ([]byte, error) {
 	if info, err := os.Stat(path); err != nil || info.IsDir() {
 		return nil, errCacheMiss
@@ -179,18 +491,23 @@ func readFile(path string) ([]byte, error) {
 
 }
 
-// Set sets the value for the given key into the cache
-func (c *FileCache) Set(key string, val []byte, expiry time.Duration, etag string) error {
-	mu := c.pm.MutexAt(key)
+// Set sets the value for the given key into the cache, keeping it for ttl
+func (c *FileCache) Set(ctx context.Context, key string, val []byte, expiry, ttl time.Duration, etag string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
 	mu.Lock()
 	defer mu.Unlock()
 
-	p := keyPath(c.path, key)
 	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
 		return fmt.Errorf("error creating file path: %w", err)
 	}
 
-	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE, 0600)
+	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("error creating file: %w", err)
 	}
@@ -199,40 +516,48 @@ func (c *FileCache) Set(key string, val []byte, expiry time.Duration, etag strin
 		_ = f.Close()
 	}()
 
-	timestamp := uint64(time.Now().Add(expiry).Unix())
-
-	var t [8]byte
+	timestamp := uint64(time.Now().Add(ttl).Unix())
 
-	binary.LittleEndian.PutUint64(t[:], timestamp)
+	val = provider.Seal(val)
+	data := make([]byte, headerSize, headerSize+len(key)+len(val))
 
-	if _, err = f.Write(t[:]); err != nil {
-		return fmt.Errorf("error writing file: %w", err)
-	}
+	binary.LittleEndian.PutUint64(data[:8], timestamp)
+	binary.LittleEndian.PutUint32(data[8:headerSize], uint32(len(key)))
+	data = append(data, key...)
+	data = append(data, val...)
 
-	if _, err = f.Write(val); err != nil {
+	if _, err = f.Write(data); err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
 	if c.memory {
-		c.items[p] = append(t[:], val...)
+		c.setInMemory(p, data)
 	}
 
 	return nil
 }
 
-func keyHash(key string) [4]byte {
-	h := crc32.Checksum([]byte(key), crc32.IEEETable)
-
-	var b [4]byte
+func (c *FileCache) setInMemory(path string, data []byte) {
+	c.itemsMu.Lock()
+	c.items[path] = data
+	c.itemsMu.Unlock()
+}
 
-	binary.LittleEndian.PutUint32(b[:], h)
+func (c *FileCache) deleteFromMemory(path string) {
+	if !c.memory {
+		return
+	}
 
-	return b
+	c.itemsMu.Lock()
+	delete(c.items, path)
+	c.itemsMu.Unlock()
 }
 
+// keyPath returns the path of the file of key under path, named by the
+// SHA-256 of key, so that keys of any length and characters fit a file name.
+// The key itself is stored in the file header.
 func keyPath(path, key string) string {
-	h := keyHash(key)
-	key = strings.NewReplacer("/", "-", ":", "_").Replace(key)
+	h := sha256.Sum256([]byte(key))
 
 	return filepath.Join(
 		path,
@@ -240,7 +565,7 @@ func keyPath(path, key string) string {
 		hex.EncodeToString(h[1:2]),
 		hex.EncodeToString(h[2:3]),
 		hex.EncodeToString(h[3:4]),
-		key,
+		hex.EncodeToString(h[:]),
 	)
 }
 
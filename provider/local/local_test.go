@@ -0,0 +1,299 @@
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+func TestGetChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	for _, memory := range []bool{false, true} {
+		c, err := NewFileCache(t.TempDir(), time.Minute, memory)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = c.Set(ctx, "key", []byte("value"), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		p := keyPath(c.path, "key")
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 1
+		if err = ioutil.WriteFile(p, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		c.deleteFromMemory(p)
+
+		if _, _, err = c.Get(ctx, "key", ""); !errors.Is(err, provider.ErrCorrupt) {
+			t.Fatalf("error %v, want %v", err, provider.ErrCorrupt)
+		}
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Error("corrupt file not deleted")
+		}
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewFileCache(t.TempDir(), time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"GET-h-/a b", "GET-h-/b", "GET-h-/c"} {
+		if err = c.Set(ctx, key, []byte("value"), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = c.Tag(ctx, "GET-h-/a b", []string{"t1"}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Tag(ctx, "GET-h-/b", []string{"t1", "t2"}, -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	p := keyPath(filepath.Join(c.path, tagsDir), "t1")
+	if err = c.vacuumTagFile(p, fileInfo(t, p), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, lines, err := readTagFile(p)
+	if err != nil || lines != 1 || len(keys) != 1 {
+		t.Fatalf("index after vacuum: %v, %d lines, error %v", keys, lines, err)
+	}
+	if _, ok := keys["GET-h-/a b"]; !ok {
+		t.Errorf("index after vacuum: %v", keys)
+	}
+
+	p2 := keyPath(filepath.Join(c.path, tagsDir), "t2")
+	if err = c.vacuumTagFile(p2, fileInfo(t, p2), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(p2); !os.IsNotExist(err) {
+		t.Error("expired index not removed")
+	}
+
+	if err = c.PurgeTag(ctx, "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.Get(ctx, "GET-h-/a b", ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("tagged entry: error %v", err)
+	}
+	if _, _, err = c.Get(ctx, "GET-h-/c", ""); err != nil {
+		t.Errorf("untagged entry: error %v", err)
+	}
+}
+
+func TestTagIndexLegacy(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewFileCache(t.TempDir(), time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "GET-h-/a b", []byte("value"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	p := keyPath(filepath.Join(c.path, tagsDir), "t1")
+	if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(p, []byte("GET-h-/a b\nGET-h-/gone\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.vacuumTagFile(p, fileInfo(t, p), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _, err := readTagFile(p)
+	if err != nil || len(keys) != 1 || keys["GET-h-/a b"] != 0 {
+		t.Fatalf("index after vacuum: %v, error %v", keys, err)
+	}
+
+	if err = c.PurgeTag(ctx, "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.Get(ctx, "GET-h-/a b", ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("tagged entry: error %v", err)
+	}
+}
+
+func TestPurgeTagError(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewFileCache(t.TempDir(), time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"GET-h-/a", "GET-h-/b"} {
+		if err = c.Set(ctx, key, []byte("value"), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Tag(ctx, key, []string{"t1"}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a non empty directory in place of the file of a key cannot be removed
+	blocked := keyPath(c.path, "GET-h-/a")
+	if err = os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(blocked, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.PurgeTag(ctx, "t1"); err == nil {
+		t.Fatal("purge with a failing deletion succeeded")
+	}
+	if _, _, err = c.Get(ctx, "GET-h-/b", ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("other tagged entry: error %v", err)
+	}
+
+	p := keyPath(filepath.Join(c.path, tagsDir), "t1")
+	if keys, _, err := readTagFile(p); err != nil || len(keys) != 2 {
+		t.Fatalf("index after failed purge: %v, error %v", keys, err)
+	}
+
+	if err = os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.PurgeTag(ctx, "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(p); !os.IsNotExist(err) {
+		t.Error("index not removed after purge")
+	}
+}
+
+func TestKeysCorruptHeader(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewFileCache(t.TempDir(), time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "GET-h-/a", []byte("value"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key length far beyond the size of the file, and a truncated header
+	huge := make([]byte, 20)
+	binary.LittleEndian.PutUint32(huge[8:headerSize], 0xF0000000)
+	for name, data := range map[string][]byte{"huge": huge, "short": huge[:10]} {
+		if err = ioutil.WriteFile(filepath.Join(c.path, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := c.Keys(ctx, "GET-h-/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "GET-h-/a" {
+		t.Errorf("keys %v, want [GET-h-/a]", keys)
+	}
+
+	p := filepath.Join(c.path, "huge")
+	if _, err = readKey(p, fileInfo(t, p)); !errors.Is(err, provider.ErrCorrupt) {
+		t.Errorf("error %v, want %v", err, provider.ErrCorrupt)
+	}
+}
+
+func TestLongKey(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewFileCache(t.TempDir(), time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "GET-h-/search?q=" + strings.Repeat("a/b:c", 100)
+	if err = c.Set(ctx, key, []byte("value"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, err := c.Get(ctx, key, ""); err != nil || string(val) != "value" {
+		t.Errorf("got %q, error %v", val, err)
+	}
+	if keys, err := c.Keys(ctx, "GET-h-/search"); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("keys %q, error %v", keys, err)
+	}
+	if err = c.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.Get(ctx, key, ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("error %v after delete, want %v", err, provider.ErrNotFound)
+	}
+}
+
+func TestVacuumLocksKey(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewFileCache(t.TempDir(), time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "key", []byte("value"), time.Minute, -time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock taken by Get, Set and Delete for the key
+	p := keyPath(c.path, "key")
+	info := fileInfo(t, p)
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+
+	done := make(chan struct{})
+	go func() {
+		_ = c.vacuumFile(p, info, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Error("vacuum did not wait for the lock of the key")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mu.Unlock()
+	<-done
+
+	if _, err = os.Stat(p); !os.IsNotExist(err) {
+		t.Error("expired file not removed")
+	}
+}
+
+func fileInfo(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
@@ -0,0 +1,246 @@
+// Package memory is an in-memory cache
+package memory
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+var errTooLarge = errors.New("value larger than the memory cache")
+
+// Cache DB implementation, evicting the least recently used entries once
+// the stored keys and values exceed maxSize bytes.
+type MemoryCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	lru     *list.List
+	items   map[string]*list.Element
+	tags    map[string]map[string]bool
+
+	// done stops the vacuum, closed by Stop.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type entry struct {
+	key  string
+	val  []byte
+	etag string
+	// fresh is the time until which etag is matched, and expires the time
+	// until which the entry is kept.
+	fresh   time.Time
+	expires time.Time
+	tags    []string
+}
+
+func (e *entry) size() int {
+	return len(e.key) + len(e.val) + len(e.etag)
+}
+
+// NewMemoryCache creates a new memory cache holding up to maxSize bytes, 0 for
+// no limit, and removing expired entries every vacuum interval.
+func NewMemoryCache(maxSize int, vacuum time.Duration) (*MemoryCache, error) {
+	if maxSize < 0 {
+		return nil, errors.New("invalid memory cache size")
+	}
+
+	c := &MemoryCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   map[string]*list.Element{},
+		tags:    map[string]map[string]bool{},
+		done:    make(chan struct{}),
+	}
+
+	go c.vacuum(vacuum)
+
+	return c, nil
+}
+
+// Check availability of the cache
+func (c *MemoryCache) Check(refresh bool) bool {
+	return true
+}
+
+// Stop stops removing expired entries, so that the cache can be released.
+func (c *MemoryCache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *MemoryCache) vacuum(interval time.Duration) {
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+		}
+
+		c.mu.Lock()
+		now := time.Now()
+		for _, el := range c.items {
+			if el.Value.(*entry).expires.Before(now) {
+				c.remove(el)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Get returns the value for the given key, or reports that etag matches the
+// one it was stored with while the entry is fresh
+func (c *MemoryCache) Get(ctx context.Context, key string, etag string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false, provider.ErrNotFound
+	}
+
+	now := time.Now()
+	e := el.Value.(*entry)
+	if e.expires.Before(now) {
+		c.remove(el)
+		return nil, false, provider.ErrNotFound
+	}
+
+	c.lru.MoveToFront(el)
+
+	// an expired entry must be revalidated by the caller
+	if etag != "" && etag == e.etag && now.Before(e.fresh) {
+		return nil, true, nil
+	}
+
+	return e.val, false, nil
+}
+
+// Set sets the value for the given key into the cache, keeping it for ttl
+func (c *MemoryCache) Set(ctx context.Context, key string, val []byte, expiry, ttl time.Duration, etag string) error {
+	now := time.Now()
+	e := &entry{
+		key:     key,
+		val:     val,
+		etag:    etag,
+		fresh:   now.Add(expiry),
+		expires: now.Add(ttl),
+	}
+
+	if c.maxSize > 0 && e.size() > c.maxSize {
+		// the previous value of key must not be read instead
+		_ = c.Delete(ctx, key)
+		return errTooLarge
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e.tags = el.Value.(*entry).tags
+		c.size -= el.Value.(*entry).size()
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[key] = c.lru.PushFront(e)
+	}
+	c.size += e.size()
+
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+
+	return nil
+}
+
+// Delete deletes the given key from the cache
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	return nil
+}
+
+// remove removes an entry and its tag references. c.mu must be held.
+func (c *MemoryCache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+
+	c.lru.Remove(el)
+	delete(c.items, e.key)
+	c.size -= e.size()
+
+	for _, tag := range e.tags {
+		delete(c.tags[tag], e.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
+
+// Keys returns every key starting with the given prefix
+func (c *MemoryCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := []string{}
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Tag records key under each of the given tags, for as long as it is stored
+func (c *MemoryCache) Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*entry)
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = map[string]bool{}
+		}
+		if !c.tags[tag][key] {
+			c.tags[tag][key] = true
+			e.tags = append(e.tags, tag)
+		}
+	}
+
+	return nil
+}
+
+// PurgeTag deletes every entry recorded under the given tag
+func (c *MemoryCache) PurgeTag(ctx context.Context, tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.tags[tag] {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+	}
+	delete(c.tags, tag)
+
+	return nil
+}
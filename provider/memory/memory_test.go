@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetMatchesEtagWhileFresh(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "key", []byte("value"), 50*time.Millisecond, time.Minute, `"abc"`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, match, err := c.Get(ctx, "key", `"abc"`); err != nil || !match {
+		t.Fatalf("fresh entry: match %v, error %v", match, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	val, match, err := c.Get(ctx, "key", `"abc"`)
+	if err != nil || match || string(val) != "value" {
+		t.Fatalf("expired entry: value %q, match %v, error %v", val, match, err)
+	}
+}
+
+func TestSetTooLarge(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewMemoryCache(100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "key", []byte("old"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set(ctx, "key", make([]byte, 200), time.Minute, time.Minute, ""); err == nil {
+		t.Fatal("value larger than the cache stored")
+	}
+
+	if val, _, err := c.Get(ctx, "key", ""); err == nil {
+		t.Errorf("previous value %q still read", val)
+	}
+}
@@ -0,0 +1,42 @@
+// Package provider holds the errors and checksums shared by the cache
+// providers, and the request authentication shared by the cache server and
+// the purge requests
+package provider
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when there is no entry for a key.
+	ErrNotFound = errors.New("cache entry not found")
+	// ErrUnavailable is returned when the storage of a provider cannot be
+	// reached, see Unavailable.
+	ErrUnavailable = errors.New("cache unavailable")
+	// ErrCorrupt is returned when an entry cannot be read back. The provider
+	// deletes it.
+	ErrCorrupt = errors.New("corrupt cache entry")
+	// ErrUnsupported is returned when the storage of a provider does not
+	// support an operation.
+	ErrUnsupported = errors.New("operation not supported")
+)
+
+// Unavailable wraps the error of a storage that cannot be reached, so that it
+// matches ErrUnavailable as well as err.
+func Unavailable(err error) error {
+	return &unavailableError{err: err}
+}
+
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return ErrUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
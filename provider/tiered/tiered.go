@@ -0,0 +1,249 @@
+// Package tiered is an in-memory cache in front of another cache
+package tiered
+
+import (
+	"context"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+	"github.com/igoooor/conteo-traefik-cache/provider/memory"
+)
+
+// Tiers reported by GetTier.
+const (
+	L1 = "l1"
+	L2 = "l2"
+)
+
+// Backend is the cache the entries are stored in, behind the memory tier.
+type Backend interface {
+	Get(context.Context, string, string) ([]byte, bool, error)
+	Delete(context.Context, string) error
+	Set(context.Context, string, []byte, time.Duration, time.Duration, string) error
+	Check(bool) bool
+	Tag(context.Context, string, []string, time.Duration) error
+	PurgeTag(context.Context, string) error
+	Keys(context.Context, string) ([]string, error)
+}
+
+// batchBackend is implemented by the backends able to read and delete several
+// entries in one call.
+type batchBackend interface {
+	GetMulti(context.Context, []string) (map[string][]byte, error)
+	DeleteMulti(context.Context, []string) error
+}
+
+// RemainingFunc returns how long a value read from the backend is still stored
+// there, and false when it does not know.
+type RemainingFunc func(val []byte) (time.Duration, bool)
+
+// TagPrefixFunc returns the prefix shared by every key recorded under a tag,
+// and false when the tag does not tell its keys apart.
+type TagPrefixFunc func(tag string) (string, bool)
+
+// Cache DB implementation, keeping the entries read from and written to the
+// backend in a bounded memory cache, the first tier. An entry is kept there
+// for at most ttl, as other instances may change it in the backend, and no
+// longer than in the backend, as given by Set or the remaining func.
+type TieredCache struct {
+	l1        *memory.MemoryCache
+	l2        Backend
+	ttl       time.Duration
+	remaining RemainingFunc
+	tagPrefix TagPrefixFunc
+}
+
+// NewTieredCache creates a new tiered cache in front of l2, holding up to
+// maxSize bytes in memory for at most ttl. remaining, which may be nil, bounds
+// the time the values read from l2 are kept in memory. tagPrefix, which may be
+// nil, limits the entries a tag purge drops from memory.
+func NewTieredCache(l2 Backend, maxSize int, ttl, vacuum time.Duration, remaining RemainingFunc, tagPrefix TagPrefixFunc) (*TieredCache, error) {
+	l1, err := memory.NewMemoryCache(maxSize, vacuum)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TieredCache{
+		l1:        l1,
+		l2:        l2,
+		ttl:       ttl,
+		remaining: remaining,
+		tagPrefix: tagPrefix,
+	}, nil
+}
+
+// stopper is implemented by the backends running a background vacuum.
+type stopper interface {
+	Stop()
+}
+
+// Stop stops the vacuum of the memory tier, and the one of the backend, if
+// any, so that the cache can be released.
+func (c *TieredCache) Stop() {
+	c.l1.Stop()
+
+	if s, ok := c.l2.(stopper); ok {
+		s.Stop()
+	}
+}
+
+// Check availability of the backend
+func (c *TieredCache) Check(refresh bool) bool {
+	return c.l2.Check(refresh)
+}
+
+// Get returns the value for the given key, or reports that etag matches the
+// one it was stored with while the entry is fresh
+func (c *TieredCache) Get(ctx context.Context, key string, etag string) ([]byte, bool, error) {
+	val, match, _, err := c.GetTier(ctx, key, etag)
+
+	return val, match, err
+}
+
+// GetTier is Get, also returning the tier the entry was found in.
+func (c *TieredCache) GetTier(ctx context.Context, key string, etag string) ([]byte, bool, string, error) {
+	val, match, err := c.l1.Get(ctx, key, etag)
+	if err == nil {
+		return val, match, L1, nil
+	}
+
+	val, match, err = c.l2.Get(ctx, key, etag)
+	if err != nil || match {
+		return val, match, L2, err
+	}
+
+	// the ETag of the entry is unknown, it is only matched by the backend
+	c.keep(ctx, key, val)
+
+	return val, false, L2, nil
+}
+
+// keep stores val read from the backend in memory, for at most ttl and no
+// longer than it remains in the backend.
+func (c *TieredCache) keep(ctx context.Context, key string, val []byte) {
+	ttl := c.ttl
+	if c.remaining != nil {
+		if remaining, ok := c.remaining(val); ok && remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	if ttl <= 0 || c.l1.Set(ctx, key, val, ttl, ttl, "") != nil {
+		_ = c.l1.Delete(ctx, key)
+	}
+}
+
+// Set sets the value for the given key into both tiers
+func (c *TieredCache) Set(ctx context.Context, key string, val []byte, expiry, ttl time.Duration, etag string) error {
+	if err := c.l2.Set(ctx, key, val, expiry, ttl, etag); err != nil {
+		_ = c.l1.Delete(ctx, key)
+		return err
+	}
+
+	l1TTL := ttl
+	if c.ttl < l1TTL {
+		l1TTL = c.ttl
+	}
+
+	// an entry too large for the memory tier is only in the backend
+	if err := c.l1.Set(ctx, key, val, expiry, l1TTL, etag); err != nil {
+		_ = c.l1.Delete(ctx, key)
+	}
+
+	return nil
+}
+
+// Delete deletes the given key from both tiers
+func (c *TieredCache) Delete(ctx context.Context, key string) error {
+	err := c.l2.Delete(ctx, key)
+	_ = c.l1.Delete(ctx, key)
+
+	return err
+}
+
+// Keys returns every key of the backend starting with the given prefix
+func (c *TieredCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return c.l2.Keys(ctx, prefix)
+}
+
+// Tag records key under each of the given tags in the backend
+func (c *TieredCache) Tag(ctx context.Context, key string, tags []string, ttl time.Duration) error {
+	return c.l2.Tag(ctx, key, tags, ttl)
+}
+
+// PurgeTag deletes every entry recorded under the given tag in the backend,
+// and drops from memory the keys under the prefix of the tag or, when it has
+// none, every key, as the memory tier does not know the tags of the entries
+// read from the backend
+func (c *TieredCache) PurgeTag(ctx context.Context, tag string) error {
+	err := c.l2.PurgeTag(ctx, tag)
+
+	prefix := ""
+	if c.tagPrefix != nil {
+		prefix, _ = c.tagPrefix(tag)
+	}
+
+	keys, _ := c.l1.Keys(ctx, prefix)
+	for _, key := range keys {
+		_ = c.l1.Delete(ctx, key)
+	}
+
+	return err
+}
+
+// GetMulti returns the values of the given keys, leaving out the missing ones.
+// The keys missing from memory are read from the backend in one call, if it
+// supports it.
+func (c *TieredCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	missing := []string{}
+
+	for _, key := range keys {
+		if val, _, err := c.l1.Get(ctx, key, ""); err == nil {
+			values[key] = val
+		} else {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	b, ok := c.l2.(batchBackend)
+	if !ok {
+		return nil, provider.ErrUnsupported
+	}
+
+	found, err := b.GetMulti(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, val := range found {
+		c.keep(ctx, key, val)
+		values[key] = val
+	}
+
+	return values, nil
+}
+
+// DeleteMulti deletes the given keys from both tiers, in one call to the
+// backend if it supports it
+func (c *TieredCache) DeleteMulti(ctx context.Context, keys []string) error {
+	b, ok := c.l2.(batchBackend)
+	if !ok {
+		return provider.ErrUnsupported
+	}
+
+	err := b.DeleteMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		_ = c.l1.Delete(ctx, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+	"github.com/igoooor/conteo-traefik-cache/provider/memory"
+)
+
+func TestReadThroughTTL(t *testing.T) {
+	ctx := context.Background()
+
+	l2, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remaining := func(val []byte) (time.Duration, bool) {
+		if string(val) == "short" {
+			return 50 * time.Millisecond, true
+		}
+		return 0, false
+	}
+
+	c, err := NewTieredCache(l2, 0, time.Minute, time.Minute, remaining, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, val := range map[string]string{"short": "short", "other": "other"} {
+		if err = l2.Set(ctx, key, []byte(val), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, tier, err := c.GetTier(ctx, key, ""); err != nil || tier != L2 {
+			t.Fatalf("%s: read from %q, error %v", key, tier, err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	for key, want := range map[string]string{"short": L2, "other": L1} {
+		if _, _, tier, err := c.GetTier(ctx, key, ""); err != nil || tier != want {
+			t.Errorf("%s: read from %q, error %v, want %q", key, tier, err, want)
+		}
+	}
+}
+
+func TestSetTooLarge(t *testing.T) {
+	ctx := context.Background()
+
+	l2, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewTieredCache(l2, 100, time.Minute, time.Minute, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := string(make([]byte, 200))
+	for _, val := range []string{"old", large} {
+		if err = c.Set(ctx, "key", []byte(val), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if val, _, tier, err := c.GetTier(ctx, "key", ""); err != nil || string(val) != large || tier != L2 {
+		t.Errorf("read %d bytes from %q, error %v", len(val), tier, err)
+	}
+}
+
+func TestPurgeTag(t *testing.T) {
+	ctx := context.Background()
+
+	tagPrefix := func(tag string) (string, bool) {
+		if !strings.HasPrefix(tag, "vary:") {
+			return "", false
+		}
+		return strings.TrimPrefix(tag, "vary:") + "-vary-", true
+	}
+
+	l2, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewTieredCache(l2, 0, time.Minute, time.Minute, nil, tagPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"k", "k-vary-1", "k-vary-2", "other", "other-vary-1"}
+	for _, key := range keys {
+		if err = c.Set(ctx, key, []byte(key), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Tag(ctx, "k-vary-1", []string{"vary:k", "t"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Tag(ctx, "k-vary-2", []string{"vary:k"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.PurgeTag(ctx, "vary:k"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		_, _, tier, err := c.GetTier(ctx, key, "")
+		switch purged := strings.HasPrefix(key, "k-vary-"); {
+		case purged && err == nil:
+			t.Errorf("%s: read from %q after its purge", key, tier)
+		case !purged && (err != nil || tier != L1):
+			t.Errorf("%s: read from %q, error %v, want %q", key, tier, err, L1)
+		}
+	}
+
+	// the keys of other tags are unknown, every key is dropped from memory
+	if err = c.PurgeTag(ctx, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := c.l1.Keys(ctx, ""); len(keys) != 0 {
+		t.Errorf("memory keys %v after a tag purge", keys)
+	}
+}
+
+// batchMemory is a memory backend reading and deleting several entries in one
+// call, counting the calls.
+type batchMemory struct {
+	*memory.MemoryCache
+	gets, deletes int
+}
+
+func (b *batchMemory) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	b.gets++
+
+	values := map[string][]byte{}
+	for _, key := range keys {
+		if val, _, err := b.Get(ctx, key, ""); err == nil {
+			values[key] = val
+		}
+	}
+
+	return values, nil
+}
+
+func (b *batchMemory) DeleteMulti(ctx context.Context, keys []string) error {
+	b.deletes++
+
+	for _, key := range keys {
+		_ = b.Delete(ctx, key)
+	}
+
+	return nil
+}
+
+func TestGetMulti(t *testing.T) {
+	ctx := context.Background()
+
+	mc, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := &batchMemory{MemoryCache: mc}
+
+	c, err := NewTieredCache(l2, 0, time.Minute, time.Minute, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "a", []byte("a"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if err = l2.Set(ctx, key, []byte(key), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values, err := c.GetMulti(ctx, []string{"a", "b", "c", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"a": []byte("a"), "b": []byte("b"), "c": []byte("c")}
+	if !reflect.DeepEqual(values, want) || l2.gets != 1 {
+		t.Errorf("values %q in %d backend calls, want %q in 1", values, l2.gets, want)
+	}
+
+	// the entries read from the backend are kept in memory
+	if _, err = c.GetMulti(ctx, []string{"a", "b", "c"}); err != nil || l2.gets != 1 {
+		t.Errorf("%d backend calls, error %v, want 1", l2.gets, err)
+	}
+	if _, _, tier, err := c.GetTier(ctx, "b", ""); err != nil || tier != L1 {
+		t.Errorf("read from %q, error %v, want %q", tier, err, L1)
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	ctx := context.Background()
+
+	mc, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := &batchMemory{MemoryCache: mc}
+
+	c, err := NewTieredCache(l2, 0, time.Minute, time.Minute, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err = c.Set(ctx, key, []byte(key), time.Minute, time.Minute, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = c.DeleteMulti(ctx, []string{"a", "b"}); err != nil || l2.deletes != 1 {
+		t.Fatalf("%d backend calls, error %v, want 1", l2.deletes, err)
+	}
+
+	for key, deleted := range map[string]bool{"a": true, "b": true, "c": false} {
+		if _, _, err := c.l1.Get(ctx, key, ""); (err != nil) != deleted {
+			t.Errorf("%s: memory error %v, deleted %v", key, err, deleted)
+		}
+		if _, _, err := l2.Get(ctx, key, ""); (err != nil) != deleted {
+			t.Errorf("%s: backend error %v, deleted %v", key, err, deleted)
+		}
+	}
+}
+
+func TestBatchUnsupported(t *testing.T) {
+	ctx := context.Background()
+
+	l2, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewTieredCache(l2, 0, time.Minute, time.Minute, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Set(ctx, "a", []byte("a"), time.Minute, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys all in memory are read without the backend
+	if values, err := c.GetMulti(ctx, []string{"a"}); err != nil || string(values["a"]) != "a" {
+		t.Errorf("values %q, error %v", values, err)
+	}
+	if _, err = c.GetMulti(ctx, []string{"a", "b"}); !errors.Is(err, provider.ErrUnsupported) {
+		t.Errorf("get error %v, want %v", err, provider.ErrUnsupported)
+	}
+	if err = c.DeleteMulti(ctx, []string{"a"}); !errors.Is(err, provider.ErrUnsupported) {
+		t.Errorf("delete error %v, want %v", err, provider.ErrUnsupported)
+	}
+}
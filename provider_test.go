@@ -0,0 +1,161 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEntryRemaining(t *testing.T) {
+	now := uint64(time.Now().Unix())
+
+	tests := []struct {
+		data cacheData
+		want time.Duration
+	}{
+		{data: cacheData{Expiry: now + 60}, want: time.Minute},
+		{data: cacheData{Expiry: now + 60, StaleUntil: now + 120, StaleIfErrorUntil: now + 90}, want: 2 * time.Minute},
+		{data: cacheData{Expiry: now + 60, StaleIfErrorUntil: now + 180}, want: 3 * time.Minute},
+		{data: cacheData{Expiry: now + 60, Headers: map[string][]string{"Etag": {`"abc"`}}}, want: 11 * time.Minute},
+		{data: cacheData{Expiry: now - 60}, want: -time.Minute},
+	}
+
+	for _, test := range tests {
+		got, ok := entryRemaining(encodeEntry(test.data), 10*time.Minute)
+		if !ok || got > test.want || got < test.want-2*time.Second {
+			t.Errorf("%+v: remaining %v, want %v", test.data, got, test.want)
+		}
+	}
+
+	if _, ok := entryRemaining(varyMarker([]string{"Accept-Language"}), 0); ok {
+		t.Error("vary marker decoded as an entry")
+	}
+}
+
+func TestStopOnDone(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	cfg := CreateConfig()
+	cfg.Provider = localProvider
+	cfg.Local.Path = t.TempDir()
+	cfg.Fallback = memoryProvider
+	cfg.L1.MaxSize = 1 << 20
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := New(ctx, http.NotFoundHandler(), cfg, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := runtime.NumGoroutine(); n <= before {
+		t.Fatalf("%d goroutines, %d before", n, before)
+	}
+
+	cancel()
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+}
+
+func TestNewErrorStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.Fallback = localProvider
+	cfg.Local.Path = t.TempDir()
+	cfg.L1.MaxSize = 1 << 20
+	cfg.SurrogateKeys = map[string]SurrogateKeys{"invalid": {URL: "("}}
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("invalid surrogate key rule accepted")
+	}
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+}
+
+// pingCache is a main provider whose healthcheck succeeds only once up is
+// set.
+type pingCache struct {
+	CacheSystem
+	up int32
+}
+
+func (c *pingCache) Check(bool) bool {
+	return atomic.LoadInt32(&c.up) == 1
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("body"))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = localProvider
+	cfg.Local.Path = t.TempDir()
+	cfg.Fallback = memoryProvider
+	cfg.HealthcheckPeriod = 3600
+	h, err := New(ctx, next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := h.(*cache)
+	main := &pingCache{CacheSystem: m.cache}
+	m.cache = main
+
+	hcCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go m.cacheHealthcheck(hcCtx, 10*time.Millisecond)
+
+	waitAvailable := func(available bool) {
+		t.Helper()
+		for i := 0; i < 100 && m.available() != available; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if m.available() != available {
+			t.Fatalf("available %v, want %v", !available, available)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/p", nil)
+	key := m.cacheKey(r)
+
+	waitAvailable(false)
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// the fallback stores and serves the entries while the main provider is
+	// down
+	_, _, mainErr := main.Get(ctx, key, "")
+	_, _, fallbackErr := m.fallback.Get(ctx, key, "")
+	if calls := atomic.LoadInt32(&calls); calls != 1 || mainErr == nil || fallbackErr != nil {
+		t.Errorf("failed over: %d backend requests, main %v, fallback %v", calls, mainErr, fallbackErr)
+	}
+
+	atomic.StoreInt32(&main.up, 1)
+	waitAvailable(true)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, _, mainErr = main.Get(ctx, key, ""); atomic.LoadInt32(&calls) != 2 || mainErr != nil {
+		t.Errorf("failed back: %d backend requests, main %v", atomic.LoadInt32(&calls), mainErr)
+	}
+}
@@ -0,0 +1,349 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+const (
+	purgeMethod        = "PURGE"
+	banMethod          = "BAN"
+	signatureHeader    = "X-Cache-Signature"
+	purgeTagsHeader    = "X-Cache-Purge-Tags"
+	purgePatternHeader = "X-Cache-Purge-Pattern"
+)
+
+// PurgeConfig configures the purge API.
+type PurgeConfig struct {
+	// Token enables bearer token authentication of purge requests.
+	Token string `json:"token" yaml:"token" toml:"token"`
+	// Secret enables HMAC-SHA256 signed purge requests.
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	// MaxSkew is the number of seconds a signature timestamp may differ from
+	// the current time.
+	MaxSkew int `json:"maxSkew" yaml:"maxSkew" toml:"maxSkew"`
+}
+
+func (m *cache) purgeEnabled() bool {
+	return m.cfg.Purge.Token != "" || m.cfg.Purge.Secret != ""
+}
+
+// isPurge reports whether r is a purge request for the middleware.
+func (m *cache) isPurge(r *http.Request) bool {
+	return (r.Method == purgeMethod || r.Method == banMethod) && m.purgeEnabled()
+}
+
+// purge handles PURGE and BAN requests.
+//
+// PURGE deletes the entry of the request URL, or the entries tagged with one
+// of the tags of the purge tags header, or the entries matching the pattern of
+// the purge pattern header. BAN deletes the entries matching the request path
+// used as a pattern.
+func (m *cache) purge(w http.ResponseWriter, r *http.Request) {
+	if !m.authorizePurge(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := m.purgeCaches(r); err != nil {
+		log.Printf("Error purging %s: %v", r.URL.RequestURI(), err)
+		w.WriteHeader(purgeErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeCaches purges the main provider, and the fallback one, if any, which
+// keeps the entries stored during an outage. It fails while the main provider
+// is unavailable, so that the purge is retried once it is back.
+func (m *cache) purgeCaches(r *http.Request) error {
+	var err error
+	if m.fallback != nil {
+		err = m.purgeCache(r, m.fallback)
+	}
+
+	if !m.available() {
+		return provider.Unavailable(errors.New("main cache unavailable"))
+	}
+
+	if e := m.purgeCache(r, m.cache); e != nil {
+		return e
+	}
+
+	return err
+}
+
+// purgeCache deletes the entries of cache selected by the purge request r.
+func (m *cache) purgeCache(r *http.Request, cache CacheSystem) error {
+	pattern := r.Header.Get(purgePatternHeader)
+	if pattern == "" && r.Method == banMethod {
+		pattern = r.URL.Path
+	}
+
+	// the entries purged are those of GET requests to the same URL
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+
+	switch tags := splitTags(r.Header.Get(purgeTagsHeader)); {
+	case len(tags) > 0:
+		return m.purgeTags(r.Context(), cache, tags)
+	case pattern != "":
+		return m.purgePattern(r.Context(), cache, m.keyPrefix(get), escapePattern(pattern))
+	default:
+		return m.purgeKey(r.Context(), cache, m.cacheKey(get))
+	}
+}
+
+// purgeErrorStatus returns the status of a purge request that failed with
+// err: 503 when the provider is unavailable, so that the caller retries, and
+// 502 otherwise.
+func purgeErrorStatus(err error) int {
+	if errors.Is(err, provider.ErrUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadGateway
+}
+
+// authorizePurge checks the bearer token or the signature of a purge request.
+func (m *cache) authorizePurge(r *http.Request) bool {
+	if provider.BearerAuthorized(r, m.cfg.Purge.Token) {
+		return true
+	}
+
+	if m.cfg.Purge.Secret != "" {
+		return m.verifyPurgeSignature(r)
+	}
+
+	return false
+}
+
+// verifyPurgeSignature checks a signature header of the form
+// "t=<unix time>, s=<hex HMAC-SHA256>", see purgeSignature. Each signature is
+// accepted once, for as long as its timestamp is within the allowed skew.
+func (m *cache) verifyPurgeSignature(r *http.Request) bool {
+	fields := provider.SignatureFields(r.Header.Get(signatureHeader))
+	timestamp, signature := fields["t"], fields["s"]
+
+	maxSkew := time.Duration(m.cfg.Purge.MaxSkew) * time.Second
+	if provider.CheckTimestamp(timestamp, maxSkew) != nil {
+		return false
+	}
+
+	expected := purgeSignature([]byte(m.cfg.Purge.Secret), timestamp, r)
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(given, expected) {
+		return false
+	}
+
+	// purge signatures have no nonce, the signature itself is recorded
+	return m.purgeNonces.Use(string(given), 2*maxSkew) == nil
+}
+
+// purgeSignature returns the HMAC-SHA256 of the timestamp, method, host,
+// request URI and purge headers of r, separated by newlines.
+func purgeSignature(secret []byte, timestamp string, r *http.Request) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(strings.Join([]string{
+		timestamp,
+		r.Method,
+		r.Host,
+		r.URL.RequestURI(),
+		r.Header.Get(purgeTagsHeader),
+		r.Header.Get(purgePatternHeader),
+	}, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// purgeKey deletes the entry at key and, when it holds a Vary marker, the
+// variants recorded under the variants tag of key.
+func (m *cache) purgeKey(ctx context.Context, cache CacheSystem, key string) error {
+	b, _, err := cache.Get(ctx, key, "")
+	switch _, ok := parseVaryMarker(b); {
+	case errors.Is(err, provider.ErrNotFound), errors.Is(err, provider.ErrCorrupt):
+	case err != nil:
+		return fmt.Errorf("reading %q: %w", key, err)
+	case ok:
+		if err = m.purgeTags(ctx, cache, []string{variantsTag(key)}); err != nil {
+			return err
+		}
+	}
+
+	return m.purgeEntry(ctx, cache, key)
+}
+
+// batchCache is implemented by the providers able to read and delete several
+// entries in one call. Their methods return provider.ErrUnsupported when their
+// storage does not support it.
+type batchCache interface {
+	GetMulti(context.Context, []string) (map[string][]byte, error)
+	DeleteMulti(context.Context, []string) error
+}
+
+// purgeEntries deletes the entries at keys, in one call if the provider
+// supports it. It returns the first error, after trying every key.
+func (m *cache) purgeEntries(ctx context.Context, cache CacheSystem, keys []string) error {
+	if bc, ok := cache.(batchCache); ok && len(keys) > 1 {
+		err := bc.DeleteMulti(ctx, keys)
+		if err == nil {
+			if m.cfg.Debug {
+				log.Printf("[Cache] DEBUG purge %v", keys)
+			}
+			return nil
+		}
+		if !errors.Is(err, provider.ErrUnsupported) {
+			return fmt.Errorf("purging %d entries: %w", len(keys), err)
+		}
+	}
+
+	var first error
+	for _, key := range keys {
+		if err := m.purgeEntry(ctx, cache, key); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// purgeEntry deletes the entry at key.
+func (m *cache) purgeEntry(ctx context.Context, cache CacheSystem, key string) error {
+	if err := cache.Delete(ctx, key); err != nil {
+		return fmt.Errorf("purging %q: %w", key, err)
+	}
+
+	if m.cfg.Debug {
+		log.Printf("[Cache] DEBUG purge %s", key)
+	}
+
+	return nil
+}
+
+// purgeTags deletes the entries tagged with one of tags. It returns the first
+// error, after trying every tag.
+func (m *cache) purgeTags(ctx context.Context, cache CacheSystem, tags []string) error {
+	var first error
+	for _, tag := range tags {
+		if err := cache.PurgeTag(ctx, tag); err != nil {
+			if first == nil {
+				first = fmt.Errorf("purging tag %q: %w", tag, err)
+			}
+		} else if m.cfg.Debug {
+			log.Printf("[Cache] DEBUG purge tag %s", tag)
+		}
+	}
+
+	return first
+}
+
+// purgePattern deletes the entries under prefix whose path matches pattern,
+// in which "*" matches any sequence of characters.
+func (m *cache) purgePattern(ctx context.Context, cache CacheSystem, prefix, pattern string) error {
+	literal := pattern
+	if i := strings.Index(pattern, "*"); i >= 0 {
+		literal = pattern[:i]
+	}
+
+	keys, err := cache.Keys(ctx, prefix+literal)
+	if err != nil {
+		return fmt.Errorf("listing keys for %q: %w", pattern, err)
+	}
+
+	matched := []string{}
+	for _, key := range keys {
+		u := m.keyURL(strings.TrimPrefix(key, prefix))
+
+		// a path pattern also matches the query strings of the path
+		if globMatch(pattern, u) || globMatch(pattern+"?*", u) {
+			matched = append(matched, key)
+		}
+	}
+
+	return m.purgeEntries(ctx, cache, matched)
+}
+
+// escapePattern escapes a pattern on decoded paths like cacheKey escapes the
+// path, keeping its "*" wildcards.
+func escapePattern(pattern string) string {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = escapePath(part)
+	}
+
+	return strings.Join(parts, "*")
+}
+
+// keyURL returns the path and query of a cache key stripped of its prefix, by
+// removing the variant, next gen format and headers suffixes added by cacheKey
+// and variantKey.
+func (m *cache) keyURL(rest string) string {
+	if i := strings.LastIndex(rest, varySeparator); i >= 0 && variantHash(rest[i+len(varySeparator):]) {
+		rest = rest[:i]
+	}
+
+	for _, format := range m.cfg.NextGenFormats {
+		if suffix := "-" + strings.ReplaceAll(format, " ", ""); strings.HasSuffix(rest, suffix) {
+			rest = strings.TrimSuffix(rest, suffix)
+			break
+		}
+	}
+
+	if i := strings.Index(rest, headersSeparator); i >= 0 {
+		rest = rest[:i]
+	}
+
+	return rest
+}
+
+// variantHash reports whether s is a variant hash, see variantKey.
+func variantHash(s string) bool {
+	if len(s) != 16 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+
+	return err == nil
+}
+
+// globMatch reports whether s matches pattern, in which "*" matches any
+// sequence of characters, including "/".
+func globMatch(pattern, s string) bool {
+	star, next := -1, 0
+	p, i := 0, 0
+
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
@@ -0,0 +1,532 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+	"github.com/igoooor/conteo-traefik-cache/provider/memory"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"/blog", "/blog", true},
+		{"/blog", "/blogs", false},
+		{"/blog/*", "/blog/", true},
+		{"/blog/*", "/blog/2020/post", true},
+		{"/blog/*", "/blog", false},
+		{"*", "/anything?at=all", true},
+		{"/*.css", "/assets/site.css", true},
+		{"/*.css", "/assets/site.css.map", false},
+		{"/a*b*c", "/aXbYc", true},
+		{"/a*b*c", "/aXbY", false},
+	}
+
+	for _, test := range tests {
+		if match := globMatch(test.pattern, test.s); match != test.match {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.s, match, test.match)
+		}
+	}
+}
+
+func TestEscapePattern(t *testing.T) {
+	tests := map[string]string{
+		"/blog/*":    "/blog/*",
+		"*":          "*",
+		"/a b/*.css": "/a%20b/*.css",
+		"/a?b*":      "/a%3Fb*",
+	}
+
+	for pattern, want := range tests {
+		if got := escapePattern(pattern); got != want {
+			t.Errorf("escapePattern(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestKeyURL(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Headers = []string{"X-Device"}
+	cfg.NextGenFormats = []string{"image/webp"}
+	m := &cache{cfg: cfg}
+
+	tests := map[string]string{
+		"/blog":                                "/blog",
+		"/blog-archive/2020":                   "/blog-archive/2020",
+		"/blog-2020":                           "/blog-2020",
+		"/blog-post":                           "/blog-post",
+		"/blog?page=2":                         "/blog?page=2",
+		"/blog-vary-0123456789abcdef":          "/blog",
+		"/blog-bW9iaWxl":                       "/blog-bW9iaWxl",
+		"/blog-QUJD":                           "/blog-QUJD",
+		"/blog headers=bW9iaWxl":               "/blog",
+		"/blog?a=b-QUJD headers=QUJD":          "/blog?a=b-QUJD",
+		"/img.png-image/webp":                  "/img.png",
+		"/img.png headers=bW9iaWxl-image/webp": "/img.png",
+		"/img.png headers=bW9iaWxl-vary-0123456789abcdef": "/img.png",
+	}
+
+	for rest, want := range tests {
+		if got := m.keyURL(rest); got != want {
+			t.Errorf("keyURL(%q) = %q, want %q", rest, got, want)
+		}
+	}
+
+	// the URL of a key is found back whatever it ends with
+	for _, target := range []string{"/blog-QUJD", "/blog-bW9iaWxl?page=2"} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+		r.Header.Set("X-Device", "mobile")
+
+		if got := m.keyURL(strings.TrimPrefix(m.cacheKey(r), m.keyPrefix(r))); got != target {
+			t.Errorf("keyURL of the key of %s = %q", target, got)
+		}
+	}
+}
+
+func TestPurgePattern(t *testing.T) {
+	ctx := context.Background()
+	prefix := "GET-example.com-"
+
+	tests := map[string][]string{
+		"/blog": {
+			"/blog",
+			"/blog-vary-0123456789abcdef",
+			"/blog?page=2",
+		},
+		"/blog/*": {
+			"/blog/2020/post",
+		},
+		"/blog*": {
+			"/blog",
+			"/blog-archive/2020",
+			"/blog-vary-0123456789abcdef",
+			"/blog/2020/post",
+			"/blog?page=2",
+			"/blogs",
+		},
+	}
+
+	for pattern, want := range tests {
+		c, err := memory.NewMemoryCache(0, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paths := []string{
+			"/blog",
+			"/blog?page=2",
+			"/blog-vary-0123456789abcdef",
+			"/blog-archive/2020",
+			"/blog/2020/post",
+			"/blogs",
+		}
+		for _, path := range paths {
+			_ = c.Set(ctx, prefix+path, []byte("x"), time.Minute, time.Minute, "")
+		}
+		_ = c.Set(ctx, "GET-other.com-/blog", []byte("x"), time.Minute, time.Minute, "")
+
+		m := &cache{cfg: CreateConfig()}
+		if err = m.purgePattern(ctx, c, prefix, pattern); err != nil {
+			t.Fatal(err)
+		}
+
+		purged := []string{}
+		for _, path := range paths {
+			if _, _, err := c.Get(ctx, prefix+path, ""); err != nil {
+				purged = append(purged, path)
+			}
+		}
+		sort.Strings(purged)
+
+		if !reflect.DeepEqual(purged, want) {
+			t.Errorf("%q purged %q, want %q", pattern, purged, want)
+		}
+		if _, _, err := c.Get(ctx, "GET-other.com-/blog", ""); err != nil {
+			t.Errorf("%q purged another host", pattern)
+		}
+	}
+}
+
+// batchTestCache deletes several entries in one call, or fails with err,
+// counting the calls.
+type batchTestCache struct {
+	CacheSystem
+	err   error
+	calls int
+}
+
+func (c *batchTestCache) GetMulti(context.Context, []string) (map[string][]byte, error) {
+	return nil, provider.ErrUnsupported
+}
+
+func (c *batchTestCache) DeleteMulti(ctx context.Context, keys []string) error {
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, key := range keys {
+		_ = c.Delete(ctx, key)
+	}
+
+	return nil
+}
+
+func TestPurgeEntries(t *testing.T) {
+	ctx := context.Background()
+	keys := []string{"GET-h-/a", "GET-h-/b"}
+
+	tests := map[error]bool{
+		nil:                        true,
+		provider.ErrUnsupported:    true,
+		errors.New("batch failed"): false,
+		provider.Unavailable(errors.New("refused")): false,
+	}
+
+	for batchErr, purged := range tests {
+		mc, err := memory.NewMemoryCache(0, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			_ = mc.Set(ctx, key, []byte("x"), time.Minute, time.Minute, "")
+		}
+		c := &batchTestCache{CacheSystem: mc, err: batchErr}
+
+		m := &cache{cfg: CreateConfig()}
+		if err = m.purgeEntries(ctx, c, keys); (err == nil) != purged {
+			t.Errorf("batch error %v: purge error %v", batchErr, err)
+		}
+		if c.calls != 1 {
+			t.Errorf("batch error %v: %d batch calls, want 1", batchErr, c.calls)
+		}
+
+		// unsupported batches fall back to deleting the entries one by one
+		for _, key := range keys {
+			if _, _, err := mc.Get(ctx, key, ""); (err != nil) != purged {
+				t.Errorf("batch error %v: %s purged %v, want %v", batchErr, key, err != nil, purged)
+			}
+		}
+	}
+}
+
+// noKeysCache fails the tests listing the cache keys.
+type noKeysCache struct {
+	CacheSystem
+	t *testing.T
+}
+
+func (c noKeysCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	c.t.Errorf("keys listed with prefix %q", prefix)
+
+	return c.CacheSystem.Keys(ctx, prefix)
+}
+
+func TestPurgeKey(t *testing.T) {
+	ctx := context.Background()
+
+	mc, err := memory.NewMemoryCache(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := noKeysCache{CacheSystem: mc, t: t}
+
+	m := &cache{cfg: CreateConfig()}
+	header := http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}
+
+	dataKeys := map[string]string{}
+	for _, path := range []string{"/blog", "/blog-archive"} {
+		for _, lang := range []string{"en", "fr"} {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+			r.Header.Set("Accept-Language", lang)
+			key := m.cacheKey(r)
+
+			if _, err = m.store(c, r, key, header, http.StatusOK, []byte("body")); err != nil {
+				t.Fatal(err)
+			}
+			dataKeys[path+" "+lang] = m.storageKey(key, header, r)
+		}
+	}
+
+	if err = m.purgeKey(ctx, c, m.cacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/blog", nil))); err != nil {
+		t.Fatal(err)
+	}
+
+	for variant, key := range dataKeys {
+		_, _, err := c.Get(ctx, key, "")
+		if purged := err != nil; purged != strings.HasPrefix(variant, "/blog ") {
+			t.Errorf("%s: purged %v", variant, purged)
+		}
+	}
+}
+
+func TestFlushHeaderRejected(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.FlushHeader = "X-Cache-Flush"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil || !strings.Contains(err.Error(), "flushHeader") {
+		t.Errorf("error %v, want flushHeader rejected", err)
+	}
+}
+
+func TestPurgeRequests(t *testing.T) {
+	methods := []string{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("body"))
+	})
+
+	for _, token := range []string{"", "token"} {
+		methods = methods[:0]
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		cfg.Purge.Token = token
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, method := range []string{http.MethodGet, purgeMethod, banMethod, http.MethodGet} {
+			r := httptest.NewRequest(method, "http://example.com/p", nil)
+			if method != http.MethodGet {
+				r.Header.Set("Authorization", "Bearer token")
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+
+		// the PURGE and BAN requests are passed to the backend unless purging
+		// is configured, in which case they delete the GET entry
+		want := []string{http.MethodGet, purgeMethod, banMethod}
+		if token != "" {
+			want = []string{http.MethodGet, http.MethodGet}
+		}
+		if !reflect.DeepEqual(methods, want) {
+			t.Errorf("token %q: backend requests %v, want %v", token, methods, want)
+		}
+	}
+}
+
+func TestPurgeSignature(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.Purge.Secret = "secret"
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(ts time.Time, tags string) *http.Request {
+		r := httptest.NewRequest(purgeMethod, "http://example.com/p", nil)
+		r.Header.Set(purgeTagsHeader, tags)
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		r.Header.Set(signatureHeader, "t="+timestamp+", s="+hex.EncodeToString(purgeSignature([]byte("secret"), timestamp, r)))
+		return r
+	}
+
+	now := time.Now()
+	signed := sign(now, "a")
+	tampered := sign(now.Add(-time.Second), "a")
+	tampered.Header.Set(purgeTagsHeader, "b")
+	upper := sign(now.Add(-2*time.Second), "a")
+
+	tests := []struct {
+		name   string
+		r      *http.Request
+		status int
+	}{
+		{name: "signed", r: signed, status: http.StatusNoContent},
+		{name: "replayed", r: signed, status: http.StatusUnauthorized},
+		{name: "tampered", r: tampered, status: http.StatusUnauthorized},
+		{name: "expired", r: sign(now.Add(-time.Hour), "a"), status: http.StatusUnauthorized},
+		{name: "unsigned", r: httptest.NewRequest(purgeMethod, "http://example.com/p", nil), status: http.StatusUnauthorized},
+		{name: "another signature", r: upper, status: http.StatusNoContent},
+		{name: "replayed in upper case", r: upper, status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		if test.name == "replayed in upper case" {
+			fields := strings.SplitN(test.r.Header.Get(signatureHeader), "s=", 2)
+			test.r.Header.Set(signatureHeader, fields[0]+"s="+strings.ToUpper(fields[1]))
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, test.r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+// failingCache fails the deletions with err.
+type failingCache struct {
+	CacheSystem
+	err error
+}
+
+func (c failingCache) Delete(context.Context, string) error {
+	return c.err
+}
+
+func (c failingCache) PurgeTag(context.Context, string) error {
+	return c.err
+}
+
+func (c failingCache) Keys(context.Context, string) ([]string, error) {
+	return nil, c.err
+}
+
+func TestPurgeErrors(t *testing.T) {
+	errs := map[error]int{
+		errors.New("failed"):                        http.StatusBadGateway,
+		provider.Unavailable(errors.New("refused")): http.StatusServiceUnavailable,
+	}
+
+	headers := []map[string]string{
+		{},
+		{purgeTagsHeader: "a b"},
+		{purgePatternHeader: "/p*"},
+	}
+
+	for err, status := range errs {
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		cfg.Purge.Token = "token"
+		h, e := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+		if e != nil {
+			t.Fatal(e)
+		}
+		m := h.(*cache)
+		m.cache = failingCache{CacheSystem: m.cache, err: err}
+
+		for _, header := range headers {
+			r := httptest.NewRequest(purgeMethod, "http://example.com/p", nil)
+			r.Header.Set("Authorization", "Bearer token")
+			for k, v := range header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != status {
+				t.Errorf("%v %v: status %d, want %d", err, header, w.Code, status)
+			}
+		}
+	}
+}
+
+func TestPurgeFailover(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.Purge.Token = "token"
+	h, err := New(ctx, http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := h.(*cache)
+	if m.fallback, err = memory.NewMemoryCache(0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	key := m.cacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/p", nil))
+	for _, c := range []CacheSystem{m.cache, m.fallback} {
+		_ = c.Set(ctx, key, []byte("x"), time.Minute, time.Minute, "")
+	}
+
+	for _, available := range []bool{false, true} {
+		m.setAvailable(available)
+
+		r := httptest.NewRequest(purgeMethod, "http://example.com/p", nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		_, _, mainErr := m.cache.Get(ctx, key, "")
+		_, _, fallbackErr := m.fallback.Get(ctx, key, "")
+
+		switch {
+		// the main provider is left as is while it is unavailable
+		case !available && (w.Code != http.StatusServiceUnavailable || mainErr != nil || fallbackErr == nil):
+			t.Errorf("failed over: status %d, main %v, fallback %v", w.Code, mainErr, fallbackErr)
+		case available && (w.Code != http.StatusNoContent || mainErr == nil):
+			t.Errorf("failed back: status %d, main %v", w.Code, mainErr)
+		}
+	}
+}
+
+func TestPurgeSurrogateKeys(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "product-1 list")
+		w.Header().Set("Cache-Tag", "shop,sale")
+		_, _ = w.Write([]byte("body"))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.Purge.Token = "token"
+	cfg.SurrogateKeys = map[string]SurrogateKeys{
+		"products": {URL: "^/products/"},
+		"mobile":   {URL: "^/products/", Headers: map[string]string{"User-Agent": "Mobile"}},
+	}
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/products/1", nil))
+	}
+
+	// the tags of the headers and of the matching rules purge the entry, the
+	// others leave it
+	tests := map[string]bool{
+		"product-1": true,
+		"list":      true,
+		"shop":      true,
+		"sale":      true,
+		"products":  true,
+		"mobile":    false,
+		"other":     false,
+	}
+
+	for tag, purged := range tests {
+		get()
+		before := atomic.LoadInt32(&calls)
+
+		r := httptest.NewRequest(purgeMethod, "http://example.com/", nil)
+		r.Header.Set("Authorization", "Bearer token")
+		r.Header.Set(purgeTagsHeader, tag)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s: purge status %d", tag, w.Code)
+		}
+
+		get()
+		if refetched := atomic.LoadInt32(&calls) > before; refetched != purged {
+			t.Errorf("%s: purged %v, want %v", tag, refetched, purged)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package conteo_traefik_cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// maxRanges is the number of ranges above which a Range header is ignored and
+// the full body sent instead.
+const maxRanges = 32
+
+// byteRange is an inclusive range of body offsets.
+type byteRange struct {
+	start, end int
+}
+
+func (br byteRange) contentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// sendRange answers a Range request from a cached full body, with a single
+// part or multipart/byteranges 206 response, or a 416 when no range can be
+// satisfied. It returns false when the full body must be sent instead.
+func sendRange(w http.ResponseWriter, r *http.Request, data cacheData) bool {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || data.Status != http.StatusOK || r.Method != http.MethodGet {
+		return false
+	}
+
+	if !ifRangeMatches(r.Header.Get("If-Range"), data) {
+		return false
+	}
+
+	size := len(data.Body)
+
+	ranges, err := parseRange(rangeHeader, size)
+	if errors.Is(err, errUnsatisfiableRange) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	if len(ranges) == 1 {
+		br := ranges[0]
+		w.Header().Set("Content-Range", br.contentRange(size))
+		w.Header().Set("Content-Length", strconv.Itoa(br.end-br.start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data.Body[br.start : br.end+1])
+		return true
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	contentType := http.Header(data.Headers).Get("Content-Type")
+
+	for _, br := range ranges {
+		part := textproto.MIMEHeader{}
+		if contentType != "" {
+			part.Set("Content-Type", contentType)
+		}
+		part.Set("Content-Range", br.contentRange(size))
+
+		pw, err := mw.CreatePart(part)
+		if err != nil {
+			return false
+		}
+		_, _ = pw.Write(data.Body[br.start : br.end+1])
+	}
+
+	_ = mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(body.Bytes())
+
+	return true
+}
+
+// rangeRequest reports whether r is a Range request, which is forwarded to the
+// backend on a miss.
+func rangeRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") != ""
+}
+
+// delRange removes the Range and If-Range headers of a backend request, so
+// that the full body is sent to be stored.
+func delRange(req *http.Request) {
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+}
+
+// fillable reports whether the full body of a partial response from the
+// backend may be cached and fits in maxBodySize, so that it is worth fetching
+// to answer the next Range requests from the cache.
+func (m *cache) fillable(r *http.Request, header http.Header) bool {
+	size, ok := completeLength(header.Get("Content-Range"))
+	if !ok || size == 0 || (m.cfg.MaxBodySize > 0 && size > m.cfg.MaxBodySize) {
+		return false
+	}
+
+	_, ok = m.freshness(r, http.StatusOK, header)
+
+	return ok
+}
+
+// completeLength returns the size of the full body from a Content-Range
+// header, and false when it is unknown.
+func completeLength(value string) (int, bool) {
+	i := strings.LastIndex(value, "/")
+	if !strings.HasPrefix(value, "bytes ") || i < 0 {
+		return 0, false
+	}
+
+	size, err := strconv.Atoi(value[i+1:])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// ifRangeMatches reports whether the If-Range validator, if any, matches the
+// stored entity tag or Last-Modified date.
+func ifRangeMatches(ifRange string, data cacheData) bool {
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// If-Range requires a strong comparison
+		return !strings.HasPrefix(ifRange, "W/") && strings.Trim(ifRange, `"`) == strings.Trim(data.Etag, `"`)
+	}
+
+	lastModified := http.Header(data.Headers).Get("Last-Modified")
+	if lastModified == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	return modified.Equal(since)
+}
+
+// parseRange parses a "bytes" Range header for a body of the given size, and
+// coalesces the overlapping and adjacent ranges. It returns
+// errUnsatisfiableRange when none of the ranges overlap the body, and an error
+// when there are more than maxRanges ranges or when they add up to more than
+// the body, so that the full body is sent instead.
+func parseRange(value string, size int) ([]byteRange, error) {
+	if !strings.HasPrefix(value, "bytes=") {
+		return nil, errors.New("invalid range unit")
+	}
+
+	ranges := []byteRange{}
+
+	for _, spec := range strings.Split(strings.TrimPrefix(value, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid range %q", spec)
+		}
+
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var br byteRange
+
+		if first == "" {
+			// suffix range: the last n bytes
+			n, err := strconv.Atoi(last)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid range %q", spec)
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, end: size - 1}
+		} else {
+			start, err := strconv.Atoi(first)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("invalid range %q", spec)
+			}
+
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.Atoi(last); err != nil || end < start {
+					return nil, fmt.Errorf("invalid range %q", spec)
+				}
+				if end > size-1 {
+					end = size - 1
+				}
+			}
+
+			if start >= size {
+				continue
+			}
+			br = byteRange{start: start, end: end}
+		}
+
+		ranges = append(ranges, br)
+		if len(ranges) > maxRanges {
+			return nil, errors.New("too many ranges")
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	sum := 0
+	for _, br := range ranges {
+		sum += br.end - br.start + 1
+	}
+	if sum > size {
+		return nil, errors.New("ranges larger than the body")
+	}
+
+	return coalesceRanges(ranges), nil
+}
+
+// coalesceRanges sorts ranges and merges the overlapping and adjacent ones.
+func coalesceRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	merged := ranges[:1]
+	for _, br := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if br.start > last.end+1 {
+			merged = append(merged, br)
+			continue
+		}
+		if br.end > last.end {
+			last.end = br.end
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,210 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value  string
+		ranges []byteRange
+		err    error
+	}{
+		{value: "bytes=0-9", ranges: []byteRange{{0, 9}}},
+		{value: "bytes=90-", ranges: []byteRange{{90, 99}}},
+		{value: "bytes=-10", ranges: []byteRange{{90, 99}}},
+		{value: "bytes=-1000", ranges: []byteRange{{0, 99}}},
+		{value: "bytes=50-1000", ranges: []byteRange{{50, 99}}},
+		{value: "bytes=0-9, 20-29", ranges: []byteRange{{0, 9}, {20, 29}}},
+		{value: "bytes=20-29,0-9", ranges: []byteRange{{0, 9}, {20, 29}}},
+		{value: "bytes=0-9,5-14", ranges: []byteRange{{0, 14}}},
+		{value: "bytes=0-9,10-19", ranges: []byteRange{{0, 19}}},
+		{value: "bytes=0-9,2-3", ranges: []byteRange{{0, 9}}},
+		{value: "bytes=100-", err: errUnsatisfiableRange},
+		{value: "bytes=-0", err: errUnsatisfiableRange},
+		{value: "bytes=0-,0-"},
+		{value: "bytes=" + strings.Repeat("0-0,", maxRanges+1)},
+		{value: "items=0-9"},
+		{value: "bytes=9-0"},
+		{value: "bytes=a-b"},
+	}
+
+	for _, test := range tests {
+		ranges, err := parseRange(test.value, 100)
+
+		switch {
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%q: error %v, want %v", test.value, err, test.err)
+		case test.err == nil && test.ranges == nil && err == nil:
+			t.Errorf("%q: ranges %v, want an error", test.value, ranges)
+		case test.ranges != nil && (err != nil || !reflect.DeepEqual(ranges, test.ranges)):
+			t.Errorf("%q: ranges %v, error %v, want %v", test.value, ranges, err, test.ranges)
+		}
+	}
+}
+
+func TestSendRange(t *testing.T) {
+	data := cacheData{
+		Status:  http.StatusOK,
+		Headers: map[string][]string{"Content-Type": {"text/plain"}},
+		Body:    []byte(strings.Repeat("0123456789", 10)),
+		Etag:    `"abc"`,
+	}
+
+	tests := []struct {
+		header  map[string]string
+		status  int
+		body    string
+		partial bool
+	}{
+		{header: map[string]string{"Range": "bytes=10-14"}, status: http.StatusPartialContent, body: "01234"},
+		{header: map[string]string{"Range": "bytes=10-14", "If-Range": `"abc"`}, status: http.StatusPartialContent, body: "01234"},
+		{header: map[string]string{"Range": "bytes=10-14", "If-Range": `"def"`}},
+		{header: map[string]string{"Range": "bytes=10-14", "If-Range": `W/"abc"`}},
+		{header: map[string]string{"Range": "bytes=0-1,5-6"}, status: http.StatusPartialContent, partial: true},
+		{header: map[string]string{"Range": "bytes=200-"}, status: http.StatusRequestedRangeNotSatisfiable},
+		{header: map[string]string{"Range": "bytes=" + strings.Repeat("0-,", 200)}},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		for k, v := range test.header {
+			r.Header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		sent := sendRange(w, r, data)
+
+		switch {
+		case test.status == 0 && sent:
+			t.Errorf("%v: sent %d, want the full body", test.header, w.Code)
+		case test.status != 0 && (!sent || w.Code != test.status):
+			t.Errorf("%v: sent %v %d, want %d", test.header, sent, w.Code, test.status)
+		case test.body != "" && w.Body.String() != test.body:
+			t.Errorf("%v: body %q, want %q", test.header, w.Body.String(), test.body)
+		case test.partial && !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges"):
+			t.Errorf("%v: content type %q", test.header, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// rangeBackend answers Range requests with a 206 of a 10 characters pattern
+// repeated to size bytes, and records their Range headers.
+type rangeBackend struct {
+	mu     sync.Mutex
+	size   int
+	ranges []string
+}
+
+func (b *rangeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.ranges = append(b.ranges, r.Header.Get("Range"))
+	b.mu.Unlock()
+
+	body := strings.Repeat("0123456789", b.size/10)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Header.Get("Range") == "bytes=10-14" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 10-14/%d", b.size))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte(body[10:15]))
+		return
+	}
+	_, _ = w.Write([]byte(body))
+}
+
+func (b *rangeBackend) requests() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string{}, b.ranges...)
+}
+
+func TestRangeMiss(t *testing.T) {
+	tests := []struct {
+		size, maxBodySize int
+		// ranges are the Range headers of the backend requests, after a miss
+		// and a second request
+		ranges []string
+	}{
+		{size: 100, maxBodySize: 1000, ranges: []string{"bytes=10-14", ""}},
+		{size: 2000, maxBodySize: 1000, ranges: []string{"bytes=10-14", "bytes=10-14"}},
+	}
+
+	for _, test := range tests {
+		backend := &rangeBackend{size: test.size}
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		cfg.MaxBodySize = test.maxBodySize
+		h, err := New(context.Background(), backend, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+			r.Header.Set("Range", "bytes=10-14")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusPartialContent || w.Body.String() != "01234" ||
+				w.Header().Get("Content-Range") != fmt.Sprintf("bytes 10-14/%d", test.size) {
+				t.Fatalf("size %d, request %d: %d %q %q", test.size, i, w.Code, w.Header().Get("Content-Range"), w.Body.String())
+			}
+
+			waitRefresh(t, h.(*cache))
+		}
+
+		if ranges := backend.requests(); !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("size %d: backend requests with ranges %q, want %q", test.size, ranges, test.ranges)
+		}
+	}
+}
+
+func TestRangeMissReverseProxy(t *testing.T) {
+	body := strings.Repeat("0123456789", 200)
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), flushingProxy(t, body), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusPartialContent || w.Body.String() != body[:10] {
+		t.Errorf("range miss: %d, %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+// waitRefresh waits for the background refreshes of m to finish.
+func waitRefresh(t *testing.T, m *cache) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		m.refreshMu.Lock()
+		n := len(m.refreshing)
+		m.refreshMu.Unlock()
+
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("refresh still running")
+}
@@ -0,0 +1,92 @@
+package conteo_traefik_cache
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const eventStreamType = "text/event-stream"
+
+// streamingRequest reports whether r opens a WebSocket or another upgraded
+// connection, or asks for an event stream, which are never cached.
+func streamingRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade") {
+		return true
+	}
+
+	return headerHasToken(r.Header, acceptHeader, eventStreamType)
+}
+
+// streamingResponse reports whether a response with the given status and
+// headers is streamed to the client and must not be captured.
+func streamingResponse(status int, header http.Header) bool {
+	if status == http.StatusSwitchingProtocols {
+		return true
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && mediaType == eventStreamType {
+		return true
+	}
+
+	return strings.EqualFold(header.Get("X-Accel-Buffering"), "no")
+}
+
+// informational reports whether status is an interim 1xx response, sent
+// before the final one.
+func informational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+// headerHasToken reports whether the comma separated values of the header
+// contain token, ignoring case and parameters.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if i := strings.Index(t, ";"); i >= 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Flush sends the response written so far to the client. A held back response
+// is not flushed: reverse proxies flush after every write of a chunked body, so
+// it is only released once its body exceeds the capture limit.
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if rw.held {
+		return
+	}
+
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the backend take over the connection, for protocol upgrades.
+// The response is not cached.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not implement http.Hijacker", rw.ResponseWriter)
+	}
+
+	rw.wroteHeader = true
+	rw.held = false
+	rw.overflow = true
+	rw.body = nil
+
+	return h.Hijack()
+}
@@ -0,0 +1,191 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReverseProxyFlushes(t *testing.T) {
+	body := strings.Repeat("0123456789", 200)
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), flushingProxy(t, body), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != body || w.Header().Get(etagHeader) == "" {
+		t.Errorf("miss: %d, ETag %q, %d bytes", w.Code, w.Header().Get(etagHeader), w.Body.Len())
+	}
+}
+
+// flushingProxy returns a reverse proxy to an origin answering body in
+// chunks, which the proxy flushes after every write.
+func flushingProxy(t *testing.T, body string) http.Handler {
+	t.Helper()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for i := 0; i < len(body); i += 500 {
+			_, _ = w.Write([]byte(body[i : i+500]))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(origin.Close)
+
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httputil.NewSingleHostReverseProxy(u)
+}
+
+func TestHijack(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = buf.Flush()
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+
+		if err != nil || string(body) != "hijacked" {
+			t.Errorf("request %d: body %q, error %v", i, body, err)
+		}
+	}
+
+	// the hijacked responses are not cached
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("%d backend requests, want 2", calls)
+	}
+}
+
+func TestStreamingBypass(t *testing.T) {
+	tests := map[string]struct {
+		header      http.Header
+		contentType string
+	}{
+		"event stream request": {header: http.Header{"Accept": {eventStreamType}}, contentType: "text/plain"},
+		"upgrade request":      {header: http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive, Upgrade"}}, contentType: "text/plain"},
+		"event stream":         {contentType: eventStreamType + "; charset=utf-8"},
+	}
+
+	for name, test := range tests {
+		var calls int32
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Type", test.contentType)
+			_, _ = w.Write([]byte("data: 1\n\n"))
+			w.(http.Flusher).Flush()
+		})
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/events", nil)
+			for k, v := range test.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if !w.Flushed || w.Body.String() != "data: 1\n\n" {
+				t.Errorf("%s, request %d: flushed %v, body %q", name, i, w.Flushed, w.Body.String())
+			}
+		}
+
+		if calls := atomic.LoadInt32(&calls); calls != 2 {
+			t.Errorf("%s: %d backend requests, want 2", name, calls)
+		}
+	}
+}
+
+func TestImplicitStatus(t *testing.T) {
+	tests := map[string]func(w http.ResponseWriter){
+		"write": func(w http.ResponseWriter) {
+			_, _ = w.Write([]byte("body"))
+		},
+		"flush": func(w http.ResponseWriter) {
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("body"))
+		},
+	}
+
+	for name, write := range tests {
+		var calls int32
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			write(w)
+		})
+
+		cfg := CreateConfig()
+		cfg.Provider = memoryProvider
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+			if w.Code != http.StatusOK || w.Body.String() != "body" {
+				t.Errorf("%s, request %d: %d %q", name, i, w.Code, w.Body.String())
+			}
+		}
+
+		// the implicit 200 is cached like an explicit one
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Errorf("%s: %d backend requests, want 1", name, calls)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
@@ -12,9 +13,9 @@ import (
 )
 
 type CacheSystem interface {
-	Get(string, string) ([]byte, bool, error)
-	Delete(string)
-	Set(string, []byte, time.Duration, string) error
+	Get(context.Context, string, string) ([]byte, bool, error)
+	Delete(context.Context, string) error
+	Set(context.Context, string, []byte, time.Duration, time.Duration, string) error
 	Check(bool) bool
 }
 
@@ -25,7 +26,7 @@ type CacheSystem interface {
 
 func main() {
 	var cache CacheSystem
-	cache, err := provider.NewFileCache("http://localhost:8081")
+	cache, err := provider.NewFileCache("http://localhost:8081", provider.Options{})
 	available := cache.Check(true)
 	log.Printf("available: %v", available)
 	if err != nil {
@@ -36,9 +37,11 @@ func main() {
 		}
 	}
 
-	cache.Set("test", []byte("test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1"), time.Duration(60)*time.Second, "")
+	ctx := context.Background()
 
-	val, _, err := cache.Get("yoloo", "")
+	cache.Set(ctx, "test", []byte("test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1test1"), time.Duration(60)*time.Second, time.Duration(60)*time.Second, "")
+
+	val, _, err := cache.Get(ctx, "yoloo", "")
 	if err != nil {
 		message := err.Error()
 		log.Println(message)
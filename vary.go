@@ -0,0 +1,100 @@
+package conteo_traefik_cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// varyPrefix starts the marker stored at the primary key of responses
+	// with a Vary header, followed by the comma separated header names.
+	varyPrefix = "vary:"
+	// varySeparator separates the primary key from the variant hash.
+	varySeparator = "-vary-"
+)
+
+// varyHeaders returns the sorted, canonical header names of the Vary header.
+func varyHeaders(header http.Header) []string {
+	seen := map[string]bool{}
+	names := []string{}
+
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// variantsTag returns the tag indexing the variants stored for key, purged
+// with key.
+func variantsTag(key string) string {
+	return varyPrefix + key
+}
+
+// variantsPrefix returns the prefix of the variants indexed under tag, and
+// false when tag is not a variants tag.
+func variantsPrefix(tag string) (string, bool) {
+	if !strings.HasPrefix(tag, varyPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(tag, varyPrefix) + varySeparator, true
+}
+
+func varyMarker(vary []string) []byte {
+	return []byte(varyPrefix + strings.Join(vary, ","))
+}
+
+// parseVaryMarker returns the header names of a Vary marker, and whether b is
+// one.
+func parseVaryMarker(b []byte) ([]string, bool) {
+	if !bytes.HasPrefix(b, []byte(varyPrefix)) {
+		return nil, false
+	}
+
+	return strings.Split(string(b[len(varyPrefix):]), ","), true
+}
+
+// variantKey returns the secondary key of the variant of key selected by the
+// values of the vary headers in r.
+func (m *cache) variantKey(key string, vary []string, r *http.Request) string {
+	h := sha256.New()
+
+	for _, name := range vary {
+		_, _ = h.Write([]byte(name + ":" + strings.Join(r.Header.Values(name), ",") + "\n"))
+	}
+
+	return key + varySeparator + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// keyVary returns the headers selecting the variant a response is stored as.
+// Accept-Encoding is left out for responses stored in the normalized encoding,
+// and added for the ones whose encoding cannot be normalized.
+func keyVary(header http.Header) []string {
+	names := []string{}
+
+	for _, name := range varyHeaders(header) {
+		if name != acceptEncodingHeader {
+			names = append(names, name)
+		}
+	}
+
+	if encodingVariant(header) {
+		names = append(names, acceptEncodingHeader)
+		sort.Strings(names)
+	}
+
+	return names
+}
@@ -0,0 +1,88 @@
+package conteo_traefik_cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/igoooor/conteo-traefik-cache/provider"
+)
+
+func TestVaryVariants(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte("lang " + r.Header.Get("Accept-Language")))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	cfg.AddStatusHeader = true
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range []string{"miss", "hit"} {
+		for _, lang := range []string{"en", "fr"} {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+			r.Header.Set("Accept-Language", lang)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Body.String() != "lang "+lang {
+				t.Errorf("%s %s: body %q", request, lang, w.Body.String())
+			}
+			if status := w.Header().Get(cacheHeader); !strings.HasPrefix(status, request) {
+				t.Errorf("%s %s: Cache-Status %q", request, lang, status)
+			}
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("%d backend requests, want 2", calls)
+	}
+}
+
+func TestVaryStar(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "*")
+		_, _ = w.Write([]byte("body"))
+	})
+
+	cfg := CreateConfig()
+	cfg.Provider = memoryProvider
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := h.(*cache)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+
+		if w.Body.String() != "body" {
+			t.Errorf("request %d: body %q", i, w.Body.String())
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("%d backend requests, want 2", calls)
+	}
+
+	key := m.cacheKey(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	if _, _, err = m.cache.Get(context.Background(), key, ""); !errors.Is(err, provider.ErrNotFound) {
+		t.Errorf("Vary: * response stored, error %v", err)
+	}
+}